@@ -0,0 +1,256 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Actor registry - create_actor, update_actor and deactivate_actor maintain the registry of the supply chain
+//					  actors, read_actor and read_all_actors query it. Every actor is listed in the actor index,
+//					  see actorIndexStr.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) createActor (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting name, description and role")
+	}
+
+	role, err := parseActorRole(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	var actor Actor
+	actor.Name = args[0]
+	actor.Description = args[1]
+	actor.Role = role
+	actor.Active = true
+
+	fmt.Println("running createActor() - actor: " + actor.Name)
+
+	if !validKeyId(actor.Name) {
+		return nil, errors.New("Actor name can not be empty or contain NUL characters")
+	}
+
+	actorIndexAsBytes, err := stub.GetState(actorIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get actor index")
+	}
+
+	var actorIndex []string
+	json.Unmarshal(actorIndexAsBytes, &actorIndex)
+
+	if stringInSlice(actor.Name, actorIndex) {
+		return nil, errorResponse("00008", "actor already registered")
+	}
+
+	err = t.put_actor(stub, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	actorIndex = append(actorIndex, actor.Name)
+	jsonAsBytes, _ := json.Marshal(actorIndex)
+	err = stub.PutState(actorIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end create new actor")
+
+	return nil, nil
+}
+
+func (t *SimpleChaincode) updateActor (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting name, description and role")
+	}
+
+	role, err := parseActorRole(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	actor, err := t.get_actor(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	actor.Description = args[1]
+	actor.Role = role
+
+	err = t.put_actor(stub, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end update actor " + actor.Name)
+
+	return nil, nil
+}
+
+func (t *SimpleChaincode) deactivateActor (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting name of the actor")
+	}
+
+	actor, err := t.get_actor(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	actor.Active = false
+
+	err = t.put_actor(stub, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end deactivate actor " + actor.Name)
+
+	return nil, nil
+}
+
+func (t *SimpleChaincode) readActor (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting name of the actor")
+	}
+
+	actor, err := t.get_actor(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	jsonAsBytes, err := json.Marshal(actor)
+	if err != nil {
+		return nil, err
+	}
+
+	return jsonAsBytes, nil
+}
+
+func (t *SimpleChaincode) readAllActors (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	actorIndexAsBytes, err := stub.GetState(actorIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get actor index")
+	}
+
+	var actorIndex []string
+	json.Unmarshal(actorIndexAsBytes, &actorIndex)
+
+	var allActors []Actor
+	for _, name := range actorIndex {
+		actor, err := t.get_actor(stub, name)
+		if err != nil {
+			return nil, err
+		}
+		allActors = append(allActors, actor)
+	}
+
+	jsonAsBytes, err := json.Marshal(allActors)
+	if err != nil {
+		return nil, err
+	}
+
+	return jsonAsBytes, nil
+}
+
+//==============================================================================================================================
+//	 find_actor - Reads an actor from the registry, if any.
+//	 get_actor - As find_actor, failing with code 00007 if the actor has never been registered.
+//	 get_active_actor - As get_actor, but also refuses actors that have been deactivated.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) find_actor(stub shim.ChaincodeStubInterface, name string) (Actor, bool, error) {
+
+	var actor Actor
+
+	actorAsBytes, err := stub.GetState(ledgerKey(entityActor, name))
+	if err != nil {
+		return actor, false, errors.New("Failed to get actor " + name)
+	}
+
+	if actorAsBytes == nil {
+		return actor, false, nil
+	}
+
+	err = json.Unmarshal(actorAsBytes, &actor)
+	if err != nil {
+		return actor, false, errors.New("Corrupted record for actor " + name)
+	}
+
+	return actor, true, nil
+}
+
+func (t *SimpleChaincode) get_actor(stub shim.ChaincodeStubInterface, name string) (Actor, error) {
+
+	actor, found, err := t.find_actor(stub, name)
+	if err != nil {
+		return actor, err
+	}
+
+	if !found {
+		return actor, errorResponse("00007", "actor " + name + " not registered")
+	}
+
+	return actor, nil
+}
+
+func (t *SimpleChaincode) get_active_actor(stub shim.ChaincodeStubInterface, name string) (Actor, error) {
+
+	actor, err := t.get_actor(stub, name)
+	if err != nil {
+		return actor, err
+	}
+
+	if !actor.Active {
+		return actor, errorResponse("00007", "actor " + name + " not active")
+	}
+
+	return actor, nil
+}
+
+func (t *SimpleChaincode) put_actor(stub shim.ChaincodeStubInterface, actor Actor) error {
+
+	jsonAsBytes, err := json.Marshal(actor)
+	if err != nil {
+		return err
+	}
+
+	return stub.PutState(ledgerKey(entityActor, actor.Name), jsonAsBytes)
+}
+
+// parseActorRole validates the role passed as argument, which must be one of the supply chain affiliations
+func parseActorRole(value string) (Role, error) {
+
+	role, err := parseRole(value)
+	if err != nil || !role.isSupplyChain() {
+		return noRole, errorResponse("00009", "invalid role " + value + " for a supply chain actor")
+	}
+
+	return role, nil
+}
@@ -17,12 +17,18 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	//"time"
 	"encoding/json"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
 	"encoding/pem"
 	"net/url"
 	"strconv"
@@ -41,13 +47,30 @@ type Watch struct {
 	Model string 	   			`json:"model"`
 	Actor string 	   			`json:"actor"`
 	Status int					`json:"status"`
-	Secret string       		`json:"secret"`
+	SecretHash string       	`json:"secretHash,omitempty"`
+	SecretSalt string       	`json:"secretSalt,omitempty"`
+	SecretAlgorithm string      `json:"secretAlgorithm,omitempty"`
+	Secret string 				`json:"secret,omitempty"`			//segreto in chiaro dei record precedenti all'hash, vedi put_watch
 	Authenticated bool  		`json:"authenticated"`
 	Attachments []Attachment 	`json:"attachments"`
 	Loyalties []Loyalty			`json:"loyalties"`
+	Transfer *Transfer			`json:"transfer,omitempty"`
+	Version int					`json:"version"`
+}
+
+// passaggio di proprietà in attesa di essere accettato dal nuovo cliente
+type Transfer struct {
+	From string 			`json:"from"`
+	To string 				`json:"to"`
+	TokenHash string 		`json:"tokenHash,omitempty"`
+	TokenSalt string 		`json:"tokenSalt,omitempty"`
+	TokenAlgorithm string 	`json:"tokenAlgorithm,omitempty"`
 }
 
 type Loyalty struct {
+	Id string 					`json:"id"`
+	ProgramId string 			`json:"programId,omitempty"`
+	Legacy bool 				`json:"legacy,omitempty"`
 	Status int 					`json:"status"`
 	StartDate string  			`json:"startDate"`
 	EndDate string 				`json:"endDate"`
@@ -60,18 +83,32 @@ type Attachment struct {
 	URL string 		`json:"url"`
 }
 
-type Role string
-
+// stati della filiera: Watch.Status indica quale attore detiene l'orologio
 const (
-	manifacturer 	= 1
-	distributor 	= 2
-	retailer		= 3
+	statusAtManifacturer	= 0
+	statusAtDistributor		= 1
+	statusAtRetailer		= 2
 )
 
+// Transition describes a legal move of a watch along the supply chain: a caller with CallerRole, holding the watch,
+// can move a watch in status From to an actor with TargetRole, leaving it in status To
+type Transition struct {
+	From int
+	CallerRole Role
+	TargetRole Role
+	To int
+}
+
+var transitions = []Transition{
+	{ From: statusAtManifacturer, CallerRole: manifacturer, TargetRole: distributor, To: statusAtDistributor },
+	{ From: statusAtDistributor, CallerRole: distributor, TargetRole: retailer, To: statusAtRetailer },
+}
+
 type Actor struct {
 	Name string `json:"name"`
 	Description string `json:"description"`
 	Role Role `json:"role"`
+	Active bool `json:"active"`
 }
 
 type User struct {
@@ -79,9 +116,11 @@ type User struct {
 	Watches []string `json:"watches"` //contiene i seriali degli orologi in suo possesso
 }
 
+// voce della tabella degli eCert: un eCert revocato resta salvato ma non identifica più l'utente
 type User_and_eCert struct {
 	Identity string `json:"identity"`
-	eCert string `json:"ecert"`
+	ECert string `json:"ecert"`
+	Revoked bool `json:"revoked"`
 }
 
 type Response struct {
@@ -90,8 +129,44 @@ type Response struct {
 	Message string `json:"message"`
 }
 
-var watchIndexStr = "_watchindex"
-var userIndexStr = "_userindex"
+// ruoli autorizzati ad eseguire ciascuna funzione di invoke, le funzioni assenti non possono essere eseguite
+var permissions = map[string][]Role{
+	"init": 				{ manifacturer },
+	"create_watch": 		{ manifacturer },
+	"add_attachment": 		{ manifacturer },
+	"register_watch": 		{ retailer },
+	"authenticate_watch": 	{ manifacturer, retailer },
+	"addLoyalty": 			{ manifacturer, retailer },
+	"activate_loyalty": 	{ manifacturer, retailer },
+	"cancel_loyalty": 		{ manifacturer, retailer },
+	"redeem_loyalty": 		{ manifacturer, retailer },
+	"create_program": 		{ manifacturer },
+	"update_program": 		{ manifacturer },
+	"enroll_watch": 		{ manifacturer, retailer },
+	"move_to_next_actor": 	{ manifacturer, distributor },
+	"create_actor": 		{ manifacturer },
+	"update_actor": 		{ manifacturer },
+	"deactivate_actor": 	{ manifacturer },
+	"create_user": 			{ manifacturer, retailer },
+	"offer_transfer": 		{ manifacturer, retailer },
+	"accept_transfer": 		{ manifacturer, retailer },
+	"cancel_transfer": 		{ manifacturer, retailer },
+	"repair_watch_keys": 	{ manifacturer },
+	"migrate_watch_index": 	{ manifacturer },
+	"register_ecert": 		{ manifacturer },
+	"revoke_ecert": 		{ manifacturer },
+	"rotate_ecert": 		{ manifacturer },
+}
+
+// algoritmo usato per l'hash salato del segreto dell'orologio, una derivazione lenta per rendere costosa la ricerca
+// esaustiva dei segreti; gli hash sha256 registrati in precedenza restano verificabili
+var secretAlgorithm = "pbkdf2-sha256"
+var secretIterations = 100000
+var legacySecretAlgorithm = "sha256"
+
+var watchIndexStr = "_watchindex"			//indice legacy, un unico array json: vedi migrate_watch_index
+var userIndexStr = ledgerKey(entityIndex, "users")
+var actorIndexStr = ledgerKey(entityIndex, "actors")
 
 // ============================================================================================================================
 // Main
@@ -106,11 +181,14 @@ func main() {
 // Init resetta tutto
 func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 
-//inizializzo la lista di indici dei vari orologi contenuti nella blockchain
+	if len(args) % 2 != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting pairs of user name and eCert")
+	}
+
+//inizializzo l'indice dei vari orologi contenuti nella blockchain
 	var err error
 	var empty []string
-	watchIndexJsonAsBytes, _ := json.Marshal(empty)								//marshal an emtpy array of strings to clear the index
-	err = stub.PutState(watchIndexStr, watchIndexJsonAsBytes)
+	err = t.clear_watch_index(stub)
 	if err != nil {
 		return nil, err
 	}
@@ -121,8 +199,17 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string
 		return nil, err
 	}
 
+	actorIndexJsonAsBytes, _ := json.Marshal(empty)								//marshal an emtpy array of strings to clear the index
+	err = stub.PutState(actorIndexStr, actorIndexJsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
 	for i:=0; i < len(args); i=i+2 {
-		t.add_ecert(stub, args[i], args[i+1])
+		err = t.add_ecert(stub, args[i], args[i+1])
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return nil,nil
@@ -139,6 +226,11 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string
 func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	fmt.Println("invoke is running " + function)
 
+	err := t.check_permission(stub, function)
+	if err != nil {
+		return nil, err
+	}
+
 	// Handle different functions
 	if function == "init" {													//initialize the chaincode state, used as reset
 		return t.Init(stub, "init", args)
@@ -154,6 +246,42 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function stri
 		return t.authenticateWatch(stub,args)
 	} else if function == "addLoyalty" {
 		return t.addLoyalty(stub,args)
+	} else if function == "activate_loyalty" {
+		return t.activateLoyalty(stub,args)
+	} else if function == "cancel_loyalty" {
+		return t.cancelLoyalty(stub,args)
+	} else if function == "redeem_loyalty" {
+		return t.redeemLoyalty(stub,args)
+	} else if function == "create_program" {
+		return t.createProgram(stub,args)
+	} else if function == "update_program" {
+		return t.updateProgram(stub,args)
+	} else if function == "enroll_watch" {
+		return t.enrollWatch(stub,args)
+	} else if function == "create_actor" {
+		return t.createActor(stub,args)
+	} else if function == "update_actor" {
+		return t.updateActor(stub,args)
+	} else if function == "deactivate_actor" {
+		return t.deactivateActor(stub,args)
+	} else if function == "create_user" {
+		return t.createUser(stub,args)
+	} else if function == "offer_transfer" {
+		return t.offerTransfer(stub,args)
+	} else if function == "accept_transfer" {
+		return t.acceptTransfer(stub,args)
+	} else if function == "cancel_transfer" {
+		return t.cancelTransfer(stub,args)
+	} else if function == "repair_watch_keys" {
+		return t.repairWatchKeys(stub,args)
+	} else if function == "migrate_watch_index" {
+		return t.migrateWatchIndex(stub,args)
+	} else if function == "register_ecert" {
+		return t.registerECert(stub,args)
+	} else if function == "revoke_ecert" {
+		return t.revokeECert(stub,args)
+	} else if function == "rotate_ecert" {
+		return t.rotateECert(stub,args)
 	}
 	
 
@@ -184,6 +312,28 @@ func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function strin
 		return t.verify_registerWatch(stub,args)
 	} else if function == "loyalties_per_watch" {
 		return t.loyalties_per_watch(stub,args)
+	} else if function == "read_actor" {
+		return t.readActor(stub,args)
+	} else if function == "read_all_actors" {
+		return t.readAllActors(stub,args)
+	} else if function == "read_user" {
+		return t.readUser(stub,args)
+	} else if function == "watches_per_user" {
+		return t.watches_per_user(stub,args)
+	} else if function == "watches_by_model" {
+		return t.watchesByIndex(stub, entityWatchByModel, args)
+	} else if function == "watches_by_actor" {
+		return t.watchesByIndex(stub, entityWatchByActor, args)
+	} else if function == "watches_by_status" {
+		return t.watchesByStatus(stub,args)
+	} else if function == "watches_by_program" {
+		return t.watchesByIndex(stub, entityWatchByProgram, args)
+	} else if function == "read_all_programs" {
+		return t.readAllPrograms(stub,args)
+	} else if function == "query_watches" {
+		return t.queryWatches(stub,args)
+	} else if function == "watch_history" {
+		return t.watchHistory(stub,args)
 	}
 
 	fmt.Println("query did not find func: " + function)					
@@ -191,45 +341,79 @@ func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function strin
 	return nil, errors.New("Received unknown function query")
 }
 
+// read returns an entity of one of the readable types, args are the entity type and its id. With the id only the
+// entity is read as a watch, as in the original key based version of the query.
 func (t *SimpleChaincode) read (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var key, jsonResp string
-	var err error
+	var entityType, id string
+
+	if len(args) == 1 {
+		entityType = entityWatch
+		id = args[0]
+	} else if len(args) == 2 {
+		entityType = args[0]
+		id = args[1]
+	} else {
+		return nil, errors.New("Incorrect number of arguments. Expecting entity type and id to query")
+	}
 
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting name of the key to query")
+	fmt.Println("read " + entityType + ": " + id)
 
+	if !stringInSlice(entityType, readableEntities) {
+		return nil, errorResponse("00022", "entity type " + entityType + " can not be read")
 	}
 
-	key = args[0]
-	fmt.Println("key: " + key)
-	valAsbytes, err := stub.GetState(key)
+	var value interface{}
+	var err error
 
-	 if err != nil {
-        jsonResp = "{\"Error\":\"Failed to get state for " + key + "\"}"
-        return nil, errors.New(jsonResp)
-    }
+	if entityType == entityWatch {
+		//gli orologi vengono restituiti nella proiezione adatta al chiamante
+		var watch Watch
+		watch, err = t.get_watch(stub, id)
+		if err == nil {
+			value, err = t.project_watch(stub, t.get_viewer(stub), watch)
+		}
+	} else if entityType == entityActor {
+		value, err = t.get_actor(stub, id)
+	} else if entityType == entityUser {
+		value, err = t.get_visible_user(stub, id)
+	} else if entityType == entityProgram {
+		value, err = t.get_program(stub, id)
+	}
+
+	if err != nil {
+		return nil, err
+	}
 
-    return valAsbytes, nil
+	return json.Marshal(value)
 }
 
 func (t *SimpleChaincode) loyalties_per_watch (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var serial,jsonResp string
+	var serial string
 	if len(args) != 1 {
 		return nil, errors.New("Incorrect number of arguments. Expecting name of the key to query")
 
 	}
 	serial = args[0]
 	fmt.Println("serial: " + serial)
-	watchAsBytes, err := stub.GetState(serial)
+	watch, err := t.get_watch(stub, serial)
 
 	 if err != nil {
-        jsonResp = "{\"Error\":\"Failed to get state for " + serial + "\"}"
-        return nil, errors.New(jsonResp)
+        return nil, err
     }
-	
-	var watch Watch
-	json.Unmarshal(watchAsBytes, &watch)
-	var loyalties [] Loyalty = watch.Loyalties
+
+	//tipo e descrizione delle loyalty del catalogo sono quelli attuali del programma
+	view, err := t.project_watch(stub, t.get_viewer(stub), watch)
+	if err != nil {
+		return nil, err
+	}
+
+	var loyalties [] Loyalty = view.Loyalties
+
+	//la scadenza non è salvata sul ledger: viene valutata alla data della query
+	now := evaluationTime(stub)
+	for i := range loyalties {
+		loyalties[i].Status = loyaltyStatusAt(loyalties[i], now)
+	}
 
 	jsonAsBytes, err := json.Marshal(loyalties)
 	if err != nil {
@@ -241,72 +425,132 @@ func (t *SimpleChaincode) loyalties_per_watch (stub shim.ChaincodeStubInterface,
 }
 
 
+// WatchPage is a page of watches returned by the paginated queries. Total is only returned with the first page.
+// Missing lists the serials indexed without a stored watch, which are skipped.
+type WatchPage struct {
+	Items []WatchView 		`json:"items"`
+	NextBookmark string 	`json:"nextBookmark"`
+	Total *int 				`json:"total,omitempty"`
+	Missing []string 		`json:"missing,omitempty"`
+}
+
+// readAllWatches returns a page of watches, args are the optional page size and the bookmark of the previous page
 func (t *SimpleChaincode) readAllWatches (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
-	watchIndexAsBytes, err := stub.GetState(watchIndexStr)
-		if err != nil {
-			return nil, errors.New("Failed to get watch index")
-		}
+	pageSize, bookmark, err := parsePageArgs(args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := t.page_index(stub, watchIndexPrefix, pageSize, bookmark)
+	if err != nil {
+		return nil, err
+	}
 
-	var watchIndex []string
-	json.Unmarshal(watchIndexAsBytes, &watchIndex)
+	return t.watch_page(stub, t.get_viewer(stub), page)
+}
 
-	var allWatches []Watch
-	for _, x := range watchIndex {
-		var watch Watch
-		watchAsBytes, err := stub.GetState(x)
-		if err != nil {
-			return nil, errors.New("Failed to get watch")
-		}
-		json.Unmarshal(watchAsBytes, &watch)
-        allWatches = append (allWatches,watch)
-    }
+// watchesByIndex returns a page of the watches having the value passed as first argument in the secondary index,
+// followed by the optional page size and bookmark
+func (t *SimpleChaincode) watchesByIndex (stub shim.ChaincodeStubInterface, entityType string, args []string) ([]byte, error) {
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting value to search, optional page size and bookmark")
+	}
 
-    jsonAsBytes, err := json.Marshal(allWatches)
+	pageSize, bookmark, err := parsePageArgs(args, 1)
 	if err != nil {
 		return nil, err
 	}
 
-	return jsonAsBytes,nil
+	//l'indice non deve rivelare i campi che la proiezione nasconde al chiamante
+	viewer := t.get_viewer(stub)
+	if !viewer.canSeeIndex(entityType, args[0]) {
+		return nil, errorResponse("00006", "caller not authorized to list watches by " + strings.TrimPrefix(entityType, "watchby"))
+	}
+
+	page, err := t.page_index(stub, secondaryIndexRange(entityType, args[0]), pageSize, bookmark)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.watch_page(stub, viewer, page)
 }
 
-func (t *SimpleChaincode) readAllUsers (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+func (t *SimpleChaincode) watchesByStatus (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
-	userAsBytes, err := stub.GetState(userIndexStr)
+	if len(args) >= 1 {
+		status, err := strconv.Atoi(args[0])
 		if err != nil {
-			return nil, errors.New("Failed to get watch index")
+			return nil, errors.New("Status must be a number")
 		}
-		return userAsBytes,nil
+
+		//l'indice usa la forma canonica dello stato, "02" cerca gli orologi in stato 2
+		args = append([]string{ strconv.Itoa(status) }, args[1:]...)
+	}
+
+	return t.watchesByIndex(stub, entityWatchByStatus, args)
 }
 
-func (t *SimpleChaincode) isAuthenticatedWatch (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+// watch_page loads the watches of a page of serials and projects them for the caller
+func (t *SimpleChaincode) watch_page (stub shim.ChaincodeStubInterface, viewer Viewer, page IndexPage) ([]byte, error) {
 
-	var serial = args[0]
-	var secret = args[1]
+	var watchPage WatchPage
+	watchPage.Items = []WatchView{}
+	watchPage.NextBookmark = page.NextBookmark
+	watchPage.Total = page.Total
+
+	for _, serial := range page.Values {
+		watch, found, err := t.find_watch(stub, serial)
+		if err != nil {
+			return nil, err
+		}
 
-	watchIndexAsBytes, err := stub.GetState(watchIndexStr)
+		//una voce d'indice senza orologio non deve impedire di leggere gli altri
+		if !found {
+			watchPage.Missing = append(watchPage.Missing, serial)
+			continue
+		}
+
+		view, err := t.project_watch(stub, viewer, watch)
+		if err != nil {
+			return nil, err
+		}
+
+		watchPage.Items = append(watchPage.Items, view)
+	}
+
+	jsonAsBytes, err := json.Marshal(watchPage)
 	if err != nil {
-		return nil, errors.New("Failed to get watch index")
+		return nil, err
 	}
 
-	var watchIndex []string
-	json.Unmarshal(watchIndexAsBytes, &watchIndex)
+	return jsonAsBytes, nil
+}
 
-	if !stringInSlice(serial, watchIndex) {
-		return nil,errors.New ("Watch serial not exists. Verify the serial and please try again")
+func (t *SimpleChaincode) isAuthenticatedWatch (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting serial and secret")
 	}
 
+	var serial = args[0]
+	var secret = args[1]
+
 	//verifichiamo lo stato di autenticazione dell'orologio - è già stato autenticato da un altro utente?
-	
-	watchAsBytes, err := stub.GetState(serial)
+
+	watch, found, err := t.find_watch(stub, serial)
 	if err != nil {
 		return nil, err
 	}
-	var response Response
 
-	watch := unmarshWatchJson(watchAsBytes)
+	if !found {
+		return nil,errors.New ("Watch serial not exists. Verify the serial and please try again")
+	}
+
+	var response Response
 
-	if watch.Authenticated == true && secret == watch.Secret {
+	if watch.Authenticated == true && matchSecret(watch, secret) {
 		
 		response.Status = 0
 		response.Message = `{ "uuid": "`+ watch.Actor + `", "authenticated" : "` + strconv.FormatBool(watch.Authenticated) + `"}`
@@ -326,37 +570,51 @@ func (t *SimpleChaincode) isAuthenticatedWatch (stub shim.ChaincodeStubInterface
 }
 
 func (t *SimpleChaincode) verify_authenticateWatch (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting serial and secret")
+	}
+
 	var serial = args[0]
 	var secret = args[1]
 
-	var response Response
+	_, response, err := t.check_authenticateWatch(stub, serial, secret)
+	if err != nil {
+		return nil, err
+	}
 
-	watchIndexAsBytes, err := stub.GetState(watchIndexStr)
+	jsonAsBytes, err := json.Marshal(response)
 	if err != nil {
-		return nil, errors.New("Failed to get watch index")
+		return nil, err
 	}
 
-	var watchIndex []string
-	json.Unmarshal(watchIndexAsBytes, &watchIndex)
+	return jsonAsBytes, nil
+
+}
+
+//==============================================================================================================================
+//	 check_authenticateWatch - Rules a watch must satisfy to be authenticated by a customer. They are run by the
+//							   authenticate_watch invoke and, as a dry-run, by the verify_authenticate_watch query.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) check_authenticateWatch (stub shim.ChaincodeStubInterface, serial string, secret string) (Watch, Response, error) {
+
+	var response Response
 
 	//verifichiamo lo stato di autenticazione dell'orologio - è già stato autenticato da un altro utente?
-	
-	watchAsBytes, err := stub.GetState(serial)
-	
+
+	watch, found, err := t.find_watch(stub, serial)
 	if err != nil {
-		return nil, err
+		return Watch{}, response, err
 	}
 
-	watch := unmarshWatchJson(watchAsBytes)
-
-	if !stringInSlice(serial, watchIndex) {
+	if !found {
 		
 		response.Status = -1
 		response.Code = "00001" // incorrect serial or watch not present
 		response.Message = `{ "description" : "incorrect serial or watch not exists" }`
 		
-	} else if len(watch.Secret) <= 0 ||  watch.Secret != secret {
+	} else if !matchSecret(watch, secret) {
 		
 		response.Status = -1
 		response.Code = "00002" // no secret or incorrect secret 
@@ -367,47 +625,71 @@ func (t *SimpleChaincode) verify_authenticateWatch (stub shim.ChaincodeStubInter
 		response.Code = "00003" //watch already authenticated
 		response.Message = `{ "description" : "watch already authenticated"}`
 	
+	} else if holderRole(watch) != retailer {
+
+		//l'autenticazione è l'unico passaggio dal rivenditore al cliente
+		response.Status = -1
+		response.Code = "00005" // watch not at a retailer
+		response.Message = `{ "description" : "watch is not held by a ` + retailer.String() + `" }`
+
 	} else {
 		response.Status = 0
-		response.Code = "" //watch already authenticated
+		response.Code = ""
 		response.Message = `{ "description" : "watch can be authenticated"}`
 	}
 
-	jsonAsBytes, err := json.Marshal(response)
-	if err != nil {
-		return nil, err
-	}
-
-	return jsonAsBytes, nil
-
+	return watch, response, nil
 }
 
 
 func (t *SimpleChaincode) authenticateWatch (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
+	args, expected, err := expectedVersion(args, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting serial, customer code and secret")
+	}
+
 	var serial = args[0]
 	var userId = args[1]
+	var secret = args[2]
 
-	watchAsBytes, err := stub.GetState(serial)
-	
+	//il codice cliente diventa il proprietario dell'orologio e la chiave del cliente
+	if !validKeyId(userId) {
+		return nil, errors.New("Customer code can not be empty or contain NUL characters")
+	}
+
+	//le stesse verifiche di verify_authenticate_watch vengono ripetute nella transazione
+	watch, response, err := t.check_authenticateWatch(stub, serial, secret)
 	if err != nil {
 		return nil, err
 	}
 
-	watch := unmarshWatchJson(watchAsBytes)
+	if response.Status != 0 {
+		return nil, responseError(response)
+	}
+
+	err = checkVersion(serial, watch, expected)
+	if err != nil {
+		return nil, err
+	}
 
 	watch.Actor = userId
 	watch.Authenticated = true
 
-	jsonString, err := json.Marshal(watch)
+	err = t.put_watch(stub, "authenticate_watch", serial, watch)
+
 	if err != nil {
-		fmt.Println("error: ", err)
+		return nil,err
 	}
 
-	err = stub.PutState(serial, jsonString)
-
+	//l'orologio entra nella lista di quelli posseduti dal cliente
+	err = t.add_watch_to_user(stub, userId, serial)
 	if err != nil {
-		return nil,err
+		return nil, err
 	}
 
 	return nil, nil
@@ -416,58 +698,74 @@ func (t *SimpleChaincode) authenticateWatch (stub shim.ChaincodeStubInterface, a
 
 func (t *SimpleChaincode) createWatch (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting serial and watch")
+	}
+
 	var key = args [0]
 	var jsonBlob = []byte(args[1])
 
-	watch := unmarshWatchJson(jsonBlob)
+	watch, err := unmarshWatchInput(jsonBlob)
+	if err != nil {
+		return nil, err
+	}
+
+	//la chiave è l'unico riferimento all'orologio: il seriale nel json deve coincidere
+	if watch.Serial != key {
+		return nil, errorResponse("00015", "watch serial " + watch.Serial + " does not match the key " + key)
+	}
+
 	watch.Authenticated = false
 	watch.Status = 0
 
 	fmt.Println("running createWatch() - actor: " + watch.Actor)
 	fmt.Printf("watch object: %+v", watch)
 
-	//controlliamo se il seriale è già stato registrato in precedenza
+	//l'orologio nasce presso un produttore registrato e attivo
+	actor, err := t.get_active_actor(stub, watch.Actor)
+	if err != nil {
+		return nil, err
+	}
 
-	watchIndexAsBytes, err := stub.GetState(watchIndexStr)
-		if err != nil {
-			return nil, errors.New("Failed to get watch index")
-		}
+	initialRole, _ := statusRole(statusAtManifacturer)
+	if actor.Role != initialRole {
+		return nil, errorResponse("00005", "a watch can only be created at a " + initialRole.String())
+	}
 
-	var watchIndex []string
-	json.Unmarshal(watchIndexAsBytes, &watchIndex)
+	//controlliamo se il seriale è già stato registrato in precedenza
 
-	if stringInSlice(key, watchIndex) {
-		return nil, errors.New("Watch serial already exists. Change serial number and please try again")
+	if !validKeyId(key) {
+		return nil, errors.New("Watch serial can not be empty or contain NUL characters")
 	}
 
-	jsonString, err := json.Marshal(watch)
+	exists, err := t.is_indexed_watch(stub, key)
 	if err != nil {
-		fmt.Println("error: ", err)
+		return nil, err
 	}
 
-	err = stub.PutState(key, jsonString)
+	//l'indice viene svuotato da init, l'orologio salvato resta e non va sovrascritto
+	if !exists {
+		watchAsBytes, err := stub.GetState(ledgerKey(entityWatch, key))
+		if err != nil {
+			return nil, errors.New("Failed to get watch " + key)
+		}
+		exists = watchAsBytes != nil
+	}
 
-	if err != nil {
-		return nil,err
+	if exists {
+		return nil, errors.New("Watch serial already exists. Change serial number and please try again")
 	}
 
-	//get index array
+	err = t.put_watch(stub, "create_watch", key, watch)
 
-	/*watchAsBytes, err := stub.GetState(watchIndexStr)
 	if err != nil {
-		return nil, errors.New("Failed to get watch index")
+		return nil,err
 	}
 
-	var watchIndex []string
-	json.Unmarshal(watchAsBytes, &watchIndex)							//un stringify it aka JSON.parse()
-	*/
-
-	//append
-
-	watchIndex = append(watchIndex, key)								//add watch name to index list
-	fmt.Println("! watch index: ", watchIndex)
-	jsonAsBytes, _ := json.Marshal(watchIndex)
-	err = stub.PutState(watchIndexStr, jsonAsBytes)						//store name of watch
+	err = t.index_watch(stub, key)										//add watch name to index
+	if err != nil {
+		return nil, err
+	}
 
 	fmt.Println("- end create new watch")
 
@@ -481,84 +779,119 @@ func (t *SimpleChaincode) verify_registerWatch (stub shim.ChaincodeStubInterface
 	}
 
 	var serial = args[0]
-	var response Response
 
-	watchIndexAsBytes, err := stub.GetState(watchIndexStr)
+	_, response, err := t.check_registerWatch(stub, serial)
 	if err != nil {
-		return nil, errors.New("Failed to get watch index")
+		return nil, err
 	}
 
-	var watchIndex []string
-	json.Unmarshal(watchIndexAsBytes, &watchIndex)
-
-	//verifichiamo lo stato di autenticazione dell'orologio - è già stato autenticato da un altro utente?
-	
-	watchAsBytes, err := stub.GetState(serial)
-	
+	jsonAsBytes, err := json.Marshal(response)
 	if err != nil {
 		return nil, err
 	}
 
-	watch := unmarshWatchJson(watchAsBytes)
+	return jsonAsBytes, nil
+
+}
+
+//==============================================================================================================================
+//	 check_registerWatch - Rules a watch must satisfy to have a secret registered. They are run by the register_watch
+//						   invoke and, as a dry-run, by the verify_register_watch query.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) check_registerWatch (stub shim.ChaincodeStubInterface, serial string) (Watch, Response, error) {
+
+	var response Response
+
+	callerName, _, err := t.get_caller_affiliation(stub)
+	if err != nil {
+		return Watch{}, response, err
+	}
+
+	//verifichiamo lo stato di autenticazione dell'orologio - è già stato autenticato da un altro utente?
+
+	watch, found, err := t.find_watch(stub, serial)
+	if err != nil {
+		return Watch{}, response, err
+	}
 
-	if !stringInSlice(serial, watchIndex) {
+	if !found {
 		response.Status = -1
 		response.Code = "00001" // incorrect serial or watch not present
 		response.Message = `{ "description": "incorrect serial or watch not exists" }` 
-	} else if len(watch.Secret) > 0 {
+	} else if hasSecret(watch) {
 
 		response.Status = -1
-		response.Code = "00004" // incorrect serial or watch not present
+		response.Code = "00004" // watch already registered
 		response.Message = `{ "description": "watch serial already registered for a customer" }` 
 
 	} else if watch.Authenticated == true {
 
 		response.Status = -1
-		response.Code = "00003" // incorrect serial or watch not present
+		response.Code = "00003" // watch already authenticated
 		response.Message = `{ "description" : "watch already authenticated" }` 
 
+	} else if holderRole(watch) != retailer {
+
+		//il segreto viene registrato solo dal rivenditore al momento della vendita
+		response.Status = -1
+		response.Code = "00005" // watch not at a retailer
+		response.Message = `{ "description" : "watch is not held by a ` + retailer.String() + `" }`
+
+	} else if callerName != watch.Actor {
+
+		response.Status = -1
+		response.Code = "00005" // watch held by another retailer
+		response.Message = `{ "description" : "watch is not held by the caller" }`
+
 	} else {
 		response.Status = 0
-		response.Code = "" //watch already authenticated
+		response.Code = ""
 		response.Message = `{ "description" : "watch can be registered"}`
 
 	}
 
-	jsonAsBytes, err := json.Marshal(response)
-	if err != nil {
-		return nil, err
-	}
-
-	return jsonAsBytes, nil
-
+	return watch, response, nil
 }
 
 func (t *SimpleChaincode) registerWatch (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
+	args, expected, err := expectedVersion(args, 2)
+	if err != nil {
+		return nil, err
+	}
+
 	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting serial and customer code")
+		return nil, errors.New("Incorrect number of arguments. Expecting serial and secret")
 	}
 
 	var serial = args[0]
 	var secret = args[1]
-	
-	watchAsBytes, err := stub.GetState(serial)
+
+	if len(secret) == 0 {
+		return nil, errors.New("Secret can not be empty")
+	}
+
+	//una seconda registrazione non può sostituire il segreto di un cliente
+	watch, response, err := t.check_registerWatch(stub, serial)
 	if err != nil {
 		return nil, err
 	}
 
-	watch := unmarshWatchJson(watchAsBytes)
-
-	//registriamo l'hash secret dell'orologio su blockchain
+	if response.Status != 0 {
+		return nil, responseError(response)
+	}
 
-	watch.Secret = secret
-	
-	jsonString, err := json.Marshal(watch)
+	err = checkVersion(serial, watch, expected)
 	if err != nil {
-		fmt.Println("error: ", err)
+		return nil, err
 	}
 
-	err = stub.PutState(serial, jsonString)
+	//registriamo l'hash secret dell'orologio su blockchain
+
+	setSecret(stub, &watch, serial, secret)
+
+	err = t.put_watch(stub, "register_watch", serial, watch)
 
 	if err != nil {
 		return nil,err
@@ -572,30 +905,34 @@ func (t *SimpleChaincode) registerWatch (stub shim.ChaincodeStubInterface, args
 
 func (t *SimpleChaincode) addAttachment (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
-	fmt.Println("running addAttachment() for the watch with serial: " + args[0])
+	args, expected, err := expectedVersion(args, 3)
+	if err != nil {
+		return nil, err
+	}
 
 	if len(args) != 3 {
 			return nil, errors.New("Incorrect number of arguments. Expecting serial, attachment id and attachment URL")
 	}
 
-	var attachment Attachment
+	fmt.Println("running addAttachment() for the watch with serial: " + args[0])
+
+	var attachment Attachment
 	serialWatch := args[0] // id orologio
 	attachment.Id = args[1]
 	attachment.URL = args[2]
-	watchAsBytes, err := stub.GetState(serialWatch)
+	watch, err := t.get_watch(stub, serialWatch)
 	if err != nil {
 		return nil, err
 	}
 
-	watch := unmarshWatchJson(watchAsBytes)
-	watch.Attachments = append (watch.Attachments,attachment)
-
-	jsonAsBytes, err := json.Marshal(watch)
+	err = checkVersion(serialWatch, watch, expected)
 	if err != nil {
-		fmt.Println("error: ", err)
+		return nil, err
 	}
 
-	err = stub.PutState(args[0], jsonAsBytes)								//rewrite the watch with id as key
+	watch.Attachments = append (watch.Attachments,attachment)
+
+	err = t.put_watch(stub, "add_attachment", serialWatch, watch)								//rewrite the watch with id as key
 	if err != nil {
 		return nil, err
 	}
@@ -606,32 +943,46 @@ func (t *SimpleChaincode) addAttachment (stub shim.ChaincodeStubInterface, args
 
 func (t *SimpleChaincode) addLoyalty (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
-	fmt.Println("running addLoyalty() for the watch with serial: " + args[0])
+	args, expected, err := expectedVersion(args, 2)
+	if err != nil {
+		return nil, err
+	}
 
 	if len(args) != 2 {
-			return nil, errors.New("Incorrect number of arguments. Expecting serial, attachment id and attachment URL")
+			return nil, errors.New("Incorrect number of arguments. Expecting serial and loyalty")
 	}
 
-	var loyalty Loyalty
+	fmt.Println("running addLoyalty() for the watch with serial: " + args[0])
+
 	var serialWatch = args[0] // id orologio
 	var jsonBlob = []byte(args[1])
 
-	loyalty = unmarshLoyaltyJson(jsonBlob);
-
-	watchAsBytes, err := stub.GetState(serialWatch)
+	loyalty, err := unmarshLoyaltyJson(jsonBlob)
 	if err != nil {
 		return nil, err
 	}
 
-	watch := unmarshWatchJson(watchAsBytes)
-	watch.Loyalties = append (watch.Loyalties,loyalty)
+	watch, err := t.get_watch(stub, serialWatch)
+	if err != nil {
+		return nil, err
+	}
 
-	jsonAsBytes, err := json.Marshal(watch)
+	err = checkVersion(serialWatch, watch, expected)
 	if err != nil {
-		fmt.Println("error: ", err)
+		return nil, err
 	}
 
-	err = stub.PutState(serialWatch, jsonAsBytes)								//rewrite the watch with id as key
+	//la loyalty nasce in attesa di attivazione, con un id univoco per l'orologio
+	if len(loyalty.Id) == 0 {
+		loyalty.Id = nextLoyaltyId(watch)
+	} else if _, found := findLoyalty(watch, loyalty.Id); found {
+		return nil, validationError([]FieldError{ { Field: "id", Error: "already used by another loyalty of the watch" } })
+	}
+	loyalty.Status = loyaltyPending
+
+	watch.Loyalties = append (watch.Loyalties,loyalty)
+
+	err = t.put_watch(stub, "addLoyalty", serialWatch, watch)								//rewrite the watch with id as key
 	
 	if err != nil {
 		return nil, err
@@ -643,6 +994,11 @@ func (t *SimpleChaincode) addLoyalty (stub shim.ChaincodeStubInterface, args []s
 
 func (t *SimpleChaincode) moveToNextActor (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
+	args, expected, err := expectedVersion(args, 2)
+	if err != nil {
+		return nil, err
+	}
+
 	if len(args) != 2 {
 		return nil, errors.New("Incorrect number of arguments. Expecting serial and next actor as arguments")
 	}
@@ -652,22 +1008,57 @@ func (t *SimpleChaincode) moveToNextActor (stub shim.ChaincodeStubInterface, arg
 
 	fmt.Println("running moveToNextActor() for the watch with serial: " + args[0])
 
-	var watch Watch
+	watch, err := t.get_watch(stub, idWatch)
+	if err != nil {
+		return nil, err
+	}
 
-	watchAsBytes, err := stub.GetState(idWatch)
+	err = checkVersion(idWatch, watch, expected)
+	if err != nil {
+		return nil, err
+	}
 
-	watch = unmarshWatchJson(watchAsBytes)
-	watch.Actor = nextActor
-	watch.Status = watch.Status + 1
+	//un orologio già consegnato al cliente non può più muoversi lungo la filiera
+	if watch.Authenticated == true {
+		return nil, errorResponse("00003", "watch already authenticated")
+	}
+
+	callerName, callerRole, err := t.get_caller_affiliation(stub)
 	if err != nil {
 		return nil, err
 	}
-	jsonString, err := json.Marshal(watch)
+
+	//solo l'attore che detiene l'orologio può passarlo al successivo
+	if callerName != watch.Actor {
+		return nil, errorResponse("00005", "watch " + idWatch + " is not held by " + callerName)
+	}
+
+	//e solo se è ancora attivo e il suo ruolo corrisponde allo stato dell'orologio
+	holder, err := t.get_active_actor(stub, callerName)
 	if err != nil {
-		fmt.Println("error: ", err)
+		return nil, err
+	}
+
+	if holder.Role != holderRole(watch) {
+		return nil, errorResponse("00005", "watch " + idWatch + " in status " + strconv.Itoa(watch.Status) + " can not be held by a " + holder.Role.String())
+	}
+
+	actor, err := t.get_active_actor(stub, nextActor)
+	if err != nil {
+		return nil, err
 	}
 
-	err = stub.PutState(watch.Serial, jsonString)
+	targetRole := actor.Role
+
+	transition, found := findTransition(watch.Status, callerRole, targetRole)
+	if !found {
+		return nil, errorResponse("00005", "illegal supply chain transition from status " + strconv.Itoa(watch.Status) + " by role " + callerRole.String() + " to role " + targetRole.String())
+	}
+
+	watch.Actor = nextActor
+	watch.Status = transition.To
+
+	err = t.put_watch(stub, "move_to_next_actor", idWatch, watch)
 
 	if err != nil {
 		return nil,err
@@ -679,6 +1070,39 @@ func (t *SimpleChaincode) moveToNextActor (stub shim.ChaincodeStubInterface, arg
 
 }
 
+// findTransition looks up the transition table for a move allowed from the given status, caller role and target role
+func findTransition(status int, callerRole Role, targetRole Role) (Transition, bool) {
+	for _, transition := range transitions {
+		if transition.From == status && transition.CallerRole == callerRole && transition.TargetRole == targetRole {
+			return transition, true
+		}
+	}
+	return Transition{}, false
+}
+
+// errorResponse wraps a coded Response into an error, so that the invoke fails and no state is written
+func errorResponse(code string, description string) error {
+	var response Response
+	response.Status = -1
+	response.Code = code
+	descriptionAsBytes, _ := json.Marshal(description)
+	response.Message = `{ "description" : ` + string(descriptionAsBytes) + ` }`
+
+	return responseError(response)
+}
+
+// responseError turns a failed Response into the error returned by an invoke
+func responseError(response Response) error {
+	jsonAsBytes, _ := json.Marshal(response)
+	return errors.New(string(jsonAsBytes))
+}
+
+// isCodedError tells whether the error carries a coded Response, as built by errorResponse and responseError
+func isCodedError(err error) bool {
+	var response Response
+	return json.Unmarshal([]byte(err.Error()), &response) == nil && len(response.Code) > 0
+}
+
 func  unmarshWatchJson (jsonAsByte []byte) (Watch) {
 	var watch Watch
 	err := json.Unmarshal(jsonAsByte, &watch)
@@ -688,15 +1112,6 @@ func  unmarshWatchJson (jsonAsByte []byte) (Watch) {
 	return watch
 }
 
-func  unmarshLoyaltyJson (jsonAsByte []byte) (Loyalty) {
-	var loyalty Loyalty
-	err := json.Unmarshal(jsonAsByte, &loyalty)
-	if err != nil {
-		fmt.Println("error:", err)
-	}
-	return loyalty
-}
-
 func  unmarshUserJson (jsonAsByte []byte) (User) {
 	var user User
 	err := json.Unmarshal(jsonAsByte, &user)
@@ -706,6 +1121,181 @@ func  unmarshUserJson (jsonAsByte []byte) (User) {
 	return user
 }
 
+//==============================================================================================================================
+//	 Watch secret - the secret chosen by the customer is never stored: the chaincode keeps a salted hash together with
+//					the algorithm used, and compares against it. The salt is derived from the transaction id, so that
+//					every peer computes the same value. Watches registered before the hash still carry the plaintext
+//					Secret: it is honoured until put_watch replaces it with its hash at the next write of the watch.
+//					New hashes are derived with PBKDF2, the single sha256 hashes stored before are still verified.
+//==============================================================================================================================
+
+func setSecret(stub shim.ChaincodeStubInterface, watch *Watch, serial string, secret string) {
+	salt := sha256.Sum256([]byte(stub.GetTxID() + serial))
+
+	watch.SecretAlgorithm = secretAlgorithm
+	watch.SecretSalt = hex.EncodeToString(salt[:])
+	watch.SecretHash, _ = hashSecret(watch.SecretAlgorithm, watch.SecretSalt, secret)
+}
+
+func hasSecret(watch Watch) bool {
+	return len(watch.SecretHash) > 0 || len(watch.Secret) > 0
+}
+
+func matchSecret(watch Watch, secret string) bool {
+	if !hasSecret(watch) {
+		return false
+	}
+
+	if len(watch.SecretHash) == 0 {
+		return subtle.ConstantTimeCompare([]byte(secret), []byte(watch.Secret)) == 1
+	}
+
+	hash, err := hashSecret(watch.SecretAlgorithm, watch.SecretSalt, secret)
+	if err != nil {
+		fmt.Println("error: ", err)
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(watch.SecretHash)) == 1
+}
+
+func hashSecret(algorithm string, salt string, secret string) (string, error) {
+	switch algorithm {
+	case secretAlgorithm:
+		return hex.EncodeToString(pbkdf2SHA256([]byte(secret), []byte(salt), secretIterations)), nil
+	case legacySecretAlgorithm:
+		hash := sha256.Sum256([]byte(salt + secret))
+		return hex.EncodeToString(hash[:]), nil
+	}
+
+	return "", errors.New("Unsupported secret algorithm " + algorithm)
+}
+
+// pbkdf2SHA256 derives a key as long as a sha256 hash from the password, as PBKDF2 (RFC 8018) with HMAC-SHA256
+func pbkdf2SHA256(password []byte, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+
+	//un solo blocco: la chiave derivata ha la lunghezza dell'hash
+	prf.Write(salt)
+	prf.Write([]byte{ 0, 0, 0, 1 })
+	u := prf.Sum(nil)
+
+	key := make([]byte, len(u))
+	copy(key, u)
+
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+
+	return key
+}
+
+
+//==============================================================================================================================
+//	 find_watch - Loads the watch stored under the serial passed. A serial not listed in _watchindex or without a
+//				  record on the ledger is reported as not found, never as an empty watch.
+//	 get_watch - As find_watch, but fails with code 00001 when the watch does not exist.
+//	 put_watch - Writes the watch back under the serial it was loaded from, on behalf of the invoke function passed,
+//				 keeping the secondary indexes and the provenance history up to date and emitting the watch event.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) find_watch(stub shim.ChaincodeStubInterface, serial string) (Watch, bool, error) {
+
+	indexed, err := t.is_indexed_watch(stub, serial)
+	if err != nil {
+		return Watch{}, false, err
+	}
+
+	if !indexed {
+		return Watch{}, false, nil
+	}
+
+	watchAsBytes, err := stub.GetState(ledgerKey(entityWatch, serial))
+	if err != nil {
+		return Watch{}, false, errors.New("Failed to get watch " + serial)
+	}
+
+	if watchAsBytes == nil {
+		return Watch{}, false, nil
+	}
+
+	watch := unmarshWatchJson(watchAsBytes)
+	assignLoyaltyIds(&watch)
+
+	return watch, true, nil
+}
+
+func (t *SimpleChaincode) get_watch(stub shim.ChaincodeStubInterface, serial string) (Watch, error) {
+
+	watch, found, err := t.find_watch(stub, serial)
+	if err != nil {
+		return watch, err
+	}
+
+	if !found {
+		return watch, errorResponse("00001", "incorrect serial or watch not exists")
+	}
+
+	return watch, nil
+}
+
+func (t *SimpleChaincode) put_watch(stub shim.ChaincodeStubInterface, function string, serial string, watch Watch) error {
+
+	//il record precedente serve per aggiornare gli indici secondari
+	previousAsBytes, err := stub.GetState(ledgerKey(entityWatch, serial))
+	if err != nil {
+		return errors.New("Failed to get watch " + serial)
+	}
+
+	var previous *Watch
+	if previousAsBytes != nil {
+		previousWatch := unmarshWatchJson(previousAsBytes)
+		previous = &previousWatch
+	}
+
+	//il segreto in chiaro di un record precedente all'hash non viene mai riscritto
+	if len(watch.Secret) > 0 {
+		if len(watch.SecretHash) == 0 {
+			setSecret(stub, &watch, serial, watch.Secret)
+		}
+		watch.Secret = ""
+	}
+
+	//ogni scrittura porta l'orologio a una nuova versione, vedi versions.go
+	watch.Version = 1
+	if previous != nil {
+		watch.Version = previous.Version + 1
+	}
+
+	jsonAsBytes, err := json.Marshal(watch)
+	if err != nil {
+		return err
+	}
+
+	err = stub.PutState(ledgerKey(entityWatch, serial), jsonAsBytes)
+	if err != nil {
+		return err
+	}
+
+	err = t.update_secondary_indexes(stub, serial, previous, watch)
+	if err != nil {
+		return err
+	}
+
+	err = t.append_history(stub, function, serial, previous, watch)
+	if err != nil {
+		return err
+	}
+
+	return t.emit_watch_event(stub, function, serial, previous, watch)
+}
+
 func stringInSlice(a string, list []string) bool {
     for _, b := range list {
         if b == a {
@@ -719,32 +1309,55 @@ func stringInSlice(a string, list []string) bool {
 //==============================================================================================================================
 //	 General Functions
 //==============================================================================================================================
-//	 get_ecert - Takes the name passed and calls out to the REST API for HyperLedger to retrieve the ecert
-//				 for that user. Returns the ecert as retrived including html encoding.
+//	 get_ecert - Takes the name passed and retrieves the ecert for that user from the table of ecerts. Returns the
+//				 ecert as stored including html encoding, or nothing if the user has no ecert. Revoked ecerts are
+//				 refused with code 00019.
 //==============================================================================================================================
 func (t *SimpleChaincode) get_ecert(stub shim.ChaincodeStubInterface, name string) ([]byte, error) {
 
-	ecert, err := stub.GetState(name)
+	record, found, err := t.find_ecert(stub, name)
+	if err != nil { return nil, err }
+
+	if !found { return nil, nil }
 
-	if err != nil { return nil, errors.New("Could not retrieve ecert for user " + name) }
+	if record.Revoked { return nil, errorResponse("00019", "ecert revoked for user " + name) }
 
-	return ecert, nil
+	return []byte(record.ECert), nil
 }
 
 //==============================================================================================================================
-//	 add_ecert - Adds a new ecert and user pair to the table of ecerts
+//	 add_ecert - Adds a new ecert and user pair to the table of ecerts. A revoked user stays revoked, also when Init
+//				 passes its eCert again.
 //==============================================================================================================================
 
-func (t *SimpleChaincode) add_ecert(stub shim.ChaincodeStubInterface, name string, ecert string) ([]byte, error) {
+func (t *SimpleChaincode) add_ecert(stub shim.ChaincodeStubInterface, name string, ecert string) error {
 
+	if !validKeyId(name) {
+		return errors.New("User name of the eCert can not be empty or contain NUL characters")
+	}
 
-	err := stub.PutState(name, []byte(ecert))
+	_, err := decodeCertificate(ecert)
+	if err != nil {
+		return err
+	}
 
-	if err == nil {
-		return nil, errors.New("Error storing eCert for user " + name + " identity: " + ecert)
+	previous, _, err := t.find_ecert(stub, name)
+	if err != nil {
+		return err
 	}
 
-	return nil, nil
+	var record User_and_eCert
+	record.Identity = name
+	record.ECert = ecert
+	record.Revoked = previous.Revoked
+
+	err = t.put_ecert(stub, record)
+
+	if err != nil {
+		return errors.New("Error storing eCert for user " + name)
+	}
+
+	return nil
 
 }
 
@@ -755,73 +1368,281 @@ func (t *SimpleChaincode) add_ecert(stub shim.ChaincodeStubInterface, name strin
 
 func (t *SimpleChaincode) get_username(stub shim.ChaincodeStubInterface) (string, error) {
 
-	bytes, err := stub.GetCallerCertificate();
+	x509Cert, err := t.get_caller_certificate(stub)
 	if err != nil {
-		return "", errors.New("Couldn't retrieve caller certificate")
+		return "", err
 	}
 
-	x509Cert, err := x509.ParseCertificate(bytes);				// Extract Certificate from result of GetCallerCertificate
+	return x509Cert.Subject.CommonName, nil
+}
+
+// get_caller_certificate parses the certificate presented by the caller of the transaction
+func (t *SimpleChaincode) get_caller_certificate(stub shim.ChaincodeStubInterface) (*x509.Certificate, error) {
+
+	certAsBytes, err := stub.GetCallerCertificate();
 	if err != nil {
-		return "", errors.New("Couldn't parse certificate")
+		return nil, errors.New("Couldn't retrieve caller certificate")
 	}
 
-	return x509Cert.Subject.CommonName, nil
+	x509Cert, err := x509.ParseCertificate(certAsBytes);			// Extract Certificate from result of GetCallerCertificate
+	if err != nil {
+		return nil, errors.New("Couldn't parse certificate")
+	}
+
+	return x509Cert, nil
 }
 
 //==============================================================================================================================
-//	 check_affiliation - Takes an ecert as a string, decodes it to remove html encoding then parses it and checks the
-// 				  		certificates common name. The affiliation is stored as part of the common name.
+//	 check_affiliation - Takes an ecert as a string, decodes it to remove html encoding then parses it and reads the
+// 				  		affiliation of the user. The affiliation can be carried, in order of precedence, by the
+//						attributes extension of the certificate, by its organizational unit, or by the legacy
+//						encoding in the common name (name\group\affiliation). Certificates that can not be decoded
+//						fail with code 00017, certificates without a valid affiliation with code 00018.
 //==============================================================================================================================
 
-func (t *SimpleChaincode) check_affiliation(stub shim.ChaincodeStubInterface, cert string) (int, error) {
+// OID of the extension where the fabric CA stores the attributes of the certificate as json
+var attributesExtensionOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
 
+// attributi del certificato che possono contenere l'affiliazione
+var affiliationAttributes = []string{ "role", "affiliation" }
 
-	decodedCert, err := url.QueryUnescape(cert);    				// make % etc normal //
+func (t *SimpleChaincode) check_affiliation(stub shim.ChaincodeStubInterface, cert string) (Role, error) {
 
+	x509Cert, err := decodeCertificate(cert)
 	if err != nil {
-		return -1, errors.New("Could not decode certificate")
+		return noRole, err
 	}
-	pem, _ := pem.Decode([]byte(decodedCert))           				// Make Plain text   //
-	x509Cert, err := x509.ParseCertificate(pem.Bytes);				// Extract Certificate from argument //
 
-	if err != nil {
-		return -1, errors.New("Couldn't parse certificate")
+	role, found, err := affiliationFromExtension(x509Cert)
+	if found || err != nil {
+		return role, err
+	}
+
+	role, found = affiliationFromOU(x509Cert)
+	if found {
+		return role, nil
+	}
+
+	return affiliationFromCN(x509Cert)
+}
+
+// decodeCertificate accepts the pem of a certificate, either html encoded as stored by Init or in plain text. A plain
+// pem is tried as it is first: unescaping it would turn the + of the base64 body into spaces. Each form is also
+// tried as a fallback when the other does not parse.
+func decodeCertificate(cert string) (*x509.Certificate, error) {
+
+	candidates := []string{ cert }
+
+	decodedCert, err := url.QueryUnescape(cert);    				// make % etc normal //
+	if err == nil && decodedCert != cert {
+		if strings.Contains(cert, "-----BEGIN ") {
+			candidates = append(candidates, decodedCert)
+		} else {
+			candidates = []string{ decodedCert, cert }
+		}
+	}
+
+	decoded := false
+	for _, candidate := range candidates {
+		block, _ := pem.Decode([]byte(candidate))           		// Make Plain text   //
+		if block == nil {
+			continue
+		}
+		decoded = true
+
+		x509Cert, err := x509.ParseCertificate(block.Bytes);		// Extract Certificate from argument //
+		if err == nil {
+			return x509Cert, nil
+		}
+	}
+
+	if !decoded {
+		return nil, errorResponse("00017", "could not decode certificate")
+	}
+
+	return nil, errorResponse("00017", "could not parse certificate")
+}
+
+// affiliationFromExtension reads the affiliation from the attributes extension, if the certificate has one
+func affiliationFromExtension(x509Cert *x509.Certificate) (Role, bool, error) {
+
+	for _, extension := range x509Cert.Extensions {
+		if !extension.Id.Equal(attributesExtensionOID) {
+			continue
+		}
+
+		var attributes struct {
+			Attrs map[string]string `json:"attrs"`
+		}
+		err := json.Unmarshal(extension.Value, &attributes)
+		if err != nil {
+			return noRole, true, errorResponse("00017", "could not decode certificate attributes")
+		}
+
+		for _, name := range affiliationAttributes {
+			value, found := attributes.Attrs[name]
+			if !found {
+				continue
+			}
+
+			role, err := parseRole(value)
+			if err != nil {
+				return noRole, true, errorResponse("00018", "invalid affiliation " + value + " in certificate attributes")
+			}
+			return role, true, nil
+		}
+	}
+
+	return noRole, false, nil
+}
+
+// affiliationFromOU reads the affiliation from the first organizational unit naming a role
+func affiliationFromOU(x509Cert *x509.Certificate) (Role, bool) {
+
+	for _, unit := range x509Cert.Subject.OrganizationalUnit {
+		role, err := parseRole(unit)
+		if err == nil {
+			return role, true
+		}
 	}
 
+	return noRole, false
+}
+
+// affiliationFromCN reads the affiliation from the legacy common name encoding name\group\affiliation
+func affiliationFromCN(x509Cert *x509.Certificate) (Role, error) {
+
 	cn := x509Cert.Subject.CommonName
 	res := strings.Split(cn,"\\")
-	affiliation, _ := strconv.Atoi(res[2])
 
-	return affiliation, nil
+	if len(res) < 3 {
+		return noRole, errorResponse("00018", "no affiliation found in certificate")
+	}
+
+	role, err := parseRole(res[2])
+	if err != nil {
+		return noRole, errorResponse("00018", "invalid affiliation " + res[2] + " in certificate")
+	}
 
+	return role, nil
 }
 
-//=============================================================================================================================
-//	 get_caller_data - Calls the get_ecert and check_role functions and returns the ecert and role for the
-//					 name passed. To be implemented
-//=============================================================================================================================
+//==============================================================================================================================
+//	 get_affiliation - Retrieves the ecert stored for the name passed and returns the affiliation read from it.
+//==============================================================================================================================
 
+func (t *SimpleChaincode) get_affiliation(stub shim.ChaincodeStubInterface, name string) (Role, error) {
 
-func (t *SimpleChaincode) get_caller_data(stub shim.ChaincodeStubInterface) ([]byte, error){
+	ecert, err := t.get_ecert(stub, name)
+	if err != nil {
+		return noRole, err
+	}
 
-	//get caller data function 
+	if len(ecert) == 0 {
+		return noRole, errorResponse("00021", "no ecert registered for user " + name)
+	}
+
+	return t.check_affiliation(stub, string(ecert))
+}
+
+//==============================================================================================================================
+//	 check_permission - Resolves the caller of the function passed and verifies that its affiliation is one of the
+//						roles allowed to run it. Functions without an entry in the permissions table are denied, as
+//						is every function to a supply chain actor that has been deactivated.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) check_permission(stub shim.ChaincodeStubInterface, function string) error {
 
-	user, err := t.get_username(stub)
+	allowedRoles, found := permissions[function]
+	if !found {
+		return errorResponse("00006", "function " + function + " can not be invoked")
+	}
+
+	user, affiliation, err := t.get_caller_affiliation(stub)
 	if err != nil {
-		return nil, err
+		//gli errori codificati (eCert revocato, non registrato, non valido) arrivano al chiamante così come sono
+		if isCodedError(err) {
+			return err
+		}
+		return errorResponse("00006", "caller identity could not be verified")
+	}
+
+	//un attore disattivato non può più operare, anche se il suo eCert è ancora valido
+	if affiliation.isSupplyChain() {
+		actor, found, err := t.find_actor(stub, user)
+		if err != nil {
+			return err
+		}
+
+		if found && !actor.Active {
+			return errorResponse("00007", "actor " + user + " not active")
+		}
+	}
+
+	for _, role := range allowedRoles {
+		if role == affiliation {
+			return nil
+		}
+	}
+
+	fmt.Println("caller " + user + " with affiliation " + affiliation.String() + " not allowed to run " + function)
+
+	return errorResponse("00006", "caller not authorized to run " + function)
+}
+
+//==============================================================================================================================
+//	 get_caller_affiliation - Retrieves the username of the caller and the affiliation read from its ecert. The
+//							  certificate presented by the caller must be the ecert registered for its name, so that
+//							  a rotated or revoked ecert can no longer be used; otherwise it fails with code 00006.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) get_caller_affiliation(stub shim.ChaincodeStubInterface) (string, Role, error) {
+
+	callerCert, err := t.get_caller_certificate(stub)
+	if err != nil {
+		return "", noRole, err
 	}
 
-	ecert, err := t.get_ecert(stub, user);
+	user := callerCert.Subject.CommonName
+
+	affiliation, err := t.get_affiliation(stub, user)
 	if err != nil {
-		return nil, err
+		return "", noRole, err
+	}
+
+	ecert, err := t.get_ecert(stub, user)
+	if err != nil {
+		return "", noRole, err
 	}
 
-	affiliation, err := t.check_affiliation(stub,string(ecert));
+	registeredCert, err := decodeCertificate(string(ecert))
+	if err != nil {
+		return "", noRole, err
+	}
+
+	if !bytes.Equal(registeredCert.Raw, callerCert.Raw) {
+		return "", noRole, errorResponse("00006", "caller certificate is not the ecert registered for " + user)
+	}
+
+	return user, affiliation, nil
+}
+
+//=============================================================================================================================
+//	 get_caller_data - Calls the get_ecert and check_role functions and returns the ecert and role for the
+//					 name passed. To be implemented
+//=============================================================================================================================
+
+
+func (t *SimpleChaincode) get_caller_data(stub shim.ChaincodeStubInterface) ([]byte, error){
+
+	//get caller data function 
+
+	user, affiliation, err := t.get_caller_affiliation(stub)
 	if err != nil {
 		return nil, err
 	}
 
-	varToReturn := `{ "user": "`+ user + `", "affiliation" : "` + strconv.Itoa(affiliation) + `"}`
+	varToReturn := `{ "user": "`+ user + `", "affiliation" : "` + strconv.Itoa(int(affiliation)) + `", "role" : "` + affiliation.String() + `"}`
 
 	return []byte(varToReturn), nil
 
@@ -0,0 +1,190 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Identity directory - Init loads the first eCerts, then register_ecert adds the eCert of a new user, rotate_ecert
+//						  replaces the eCert of a user and revoke_ecert stops an eCert from identifying its user.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) registerECert (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting user name and eCert")
+	}
+
+	_, found, err := t.find_ecert(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if found {
+		return nil, errorResponse("00020", "ecert already registered for user " + args[0])
+	}
+
+	err = t.add_ecert(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end register ecert for user " + args[0])
+
+	return nil, nil
+}
+
+func (t *SimpleChaincode) rotateECert (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting user name and new eCert")
+	}
+
+	record, err := t.get_ecert_record(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if record.Revoked {
+		return nil, errorResponse("00019", "ecert revoked for user " + args[0])
+	}
+
+	err = t.add_ecert(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end rotate ecert for user " + args[0])
+
+	return nil, nil
+}
+
+func (t *SimpleChaincode) revokeECert (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting user name")
+	}
+
+	record, err := t.get_ecert_record(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	record.Revoked = true
+
+	err = t.put_ecert(stub, record)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end revoke ecert for user " + args[0])
+
+	return nil, nil
+}
+
+// find_ecert reads the entry of the table of ecerts for the user, if any
+func (t *SimpleChaincode) find_ecert(stub shim.ChaincodeStubInterface, name string) (User_and_eCert, bool, error) {
+
+	var record User_and_eCert
+
+	recordAsBytes, err := stub.GetState(ledgerKey(entityECert, name))
+	if err != nil {
+		return record, false, errors.New("Could not retrieve ecert for user " + name)
+	}
+
+	if recordAsBytes == nil {
+		return t.find_legacy_ecert(stub, name)
+	}
+
+	err = json.Unmarshal(recordAsBytes, &record)
+	if err != nil {
+		return record, false, errors.New("Corrupted ecert record for user " + name)
+	}
+
+	return record, true, nil
+}
+
+// find_legacy_ecert reads the ecert stored by the first versions of the chaincode as it was passed, under the bare
+// user name. The record is moved under its typed key by the next put_ecert for the user.
+func (t *SimpleChaincode) find_legacy_ecert(stub shim.ChaincodeStubInterface, name string) (User_and_eCert, bool, error) {
+
+	var record User_and_eCert
+
+	ecertAsBytes, err := stub.GetState(name)
+	if err != nil {
+		return record, false, errors.New("Could not retrieve ecert for user " + name)
+	}
+
+	if ecertAsBytes == nil {
+		return record, false, nil
+	}
+
+	//sotto il nome nudo possono esserci anche orologi o utenti salvati dalle prime versioni
+	_, err = decodeCertificate(string(ecertAsBytes))
+	if err != nil {
+		return record, false, nil
+	}
+
+	record.Identity = name
+	record.ECert = string(ecertAsBytes)
+
+	return record, true, nil
+}
+
+// get_ecert_record is find_ecert failing with code 00021 when the user has no ecert
+func (t *SimpleChaincode) get_ecert_record(stub shim.ChaincodeStubInterface, name string) (User_and_eCert, error) {
+
+	record, found, err := t.find_ecert(stub, name)
+	if err != nil {
+		return record, err
+	}
+
+	if !found {
+		return record, errorResponse("00021", "no ecert registered for user " + name)
+	}
+
+	return record, nil
+}
+
+func (t *SimpleChaincode) put_ecert(stub shim.ChaincodeStubInterface, record User_and_eCert) error {
+
+	jsonAsBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	err = stub.PutState(ledgerKey(entityECert, record.Identity), jsonAsBytes)
+	if err != nil {
+		return err
+	}
+
+	_, legacy, err := t.find_legacy_ecert(stub, record.Identity)
+	if err != nil {
+		return err
+	}
+
+	if legacy {
+		return stub.DelState(record.Identity)
+	}
+
+	return nil
+}
@@ -0,0 +1,175 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"time"
+)
+
+//==============================================================================================================================
+//	 Watch events - every change of a watch emits a chaincode event, so that off-chain systems can react without
+//					polling read_all_watches. The event name is the type of the change:
+//
+//		watch.created				create_watch
+//		watch.moved					move_to_next_actor
+//		watch.registered			register_watch
+//		watch.authenticated			authenticate_watch
+//		watch.attachment_added		add_attachment
+//		watch.loyalty_added			addLoyalty
+//		watch.loyalty_activated		activate_loyalty
+//		watch.loyalty_cancelled		cancel_loyalty
+//		watch.loyalty_redeemed		redeem_loyalty
+//		watch.enrolled				enroll_watch
+//		watch.transfer_offered		offer_transfer
+//		watch.transfer_cancelled	cancel_transfer
+//		watch.transferred			accept_transfer
+//
+//	 and the payload is the json of WatchEvent. The payload carries its version: fields are only added within the
+//	 same major version, listeners must ignore the fields they do not know.
+//
+//		{ "version": "1.0", "type": "watch.moved", "serial": "...", "txId": "...", "timestamp": "RFC3339",
+//		  "actor": "...", "status": 1, "authenticated": false, "watchVersion": 2, "previousActor": "...",
+//		  "previousStatus": 0 }
+//
+//	 previousActor and previousStatus are omitted for watch.created. The secret is never part of an event, nor is
+//	 the actor of an authenticated watch, which is the customer owning it.
+//
+//	 A transaction keeps a single event, so the functions changing many watches emit one summary event instead, with
+//	 the json of WatchBatchEvent:
+//
+//		watches.repaired			repair_watch_keys
+//
+//		{ "version": "1.0", "type": "watches.repaired", "txId": "...", "timestamp": "RFC3339", "serials": [...] }
+//==============================================================================================================================
+
+var watchEventVersion = "1.0"
+
+var watchEventTypes = map[string]string{
+	"create_watch": 		"watch.created",
+	"move_to_next_actor": 	"watch.moved",
+	"register_watch": 		"watch.registered",
+	"authenticate_watch": 	"watch.authenticated",
+	"add_attachment": 		"watch.attachment_added",
+	"addLoyalty": 			"watch.loyalty_added",
+	"activate_loyalty": 	"watch.loyalty_activated",
+	"cancel_loyalty": 		"watch.loyalty_cancelled",
+	"redeem_loyalty": 		"watch.loyalty_redeemed",
+	"enroll_watch": 		"watch.enrolled",
+	"offer_transfer": 		"watch.transfer_offered",
+	"cancel_transfer": 		"watch.transfer_cancelled",
+	"accept_transfer": 		"watch.transferred",
+}
+
+// funzioni che modificano più orologi, con un unico evento riassuntivo
+var watchBatchEventTypes = map[string]string{
+	"repair_watch_keys": 	"watches.repaired",
+}
+
+type WatchBatchEvent struct {
+	Version string 			`json:"version"`
+	Type string 			`json:"type"`
+	TxID string 			`json:"txId"`
+	Timestamp string 		`json:"timestamp"`
+	Serials []string 		`json:"serials"`
+}
+
+type WatchEvent struct {
+	Version string 			`json:"version"`
+	Type string 			`json:"type"`
+	Serial string 			`json:"serial"`
+	TxID string 			`json:"txId"`
+	Timestamp string 		`json:"timestamp"`
+	Actor string 			`json:"actor,omitempty"`
+	Status int 				`json:"status"`
+	Authenticated bool 		`json:"authenticated"`
+	WatchVersion int 		`json:"watchVersion"`
+	PreviousActor string 	`json:"previousActor,omitempty"`
+	PreviousStatus *int 	`json:"previousStatus,omitempty"`
+}
+
+// emit_watch_event sets the event describing the change made by the invoke function to the watch
+func (t *SimpleChaincode) emit_watch_event(stub shim.ChaincodeStubInterface, function string, serial string, previous *Watch, watch Watch) error {
+
+	//l'evento riassuntivo è emesso dalla funzione stessa, vedi emit_batch_event
+	if _, batched := watchBatchEventTypes[function]; batched {
+		return nil
+	}
+
+	eventType, found := watchEventTypes[function]
+	if !found {
+		eventType = "watch.updated"
+	}
+
+	txTime, err := txTimestamp(stub)
+	if err != nil {
+		return err
+	}
+
+	var event WatchEvent
+	event.Version = watchEventVersion
+	event.Type = eventType
+	event.Serial = serial
+	event.TxID = stub.GetTxID()
+	event.Timestamp = txTime.Format(time.RFC3339Nano)
+	//l'attore di un orologio autenticato è il cliente che lo possiede, non va pubblicato
+	if !watch.Authenticated {
+		event.Actor = watch.Actor
+	}
+	event.Status = watch.Status
+	event.Authenticated = watch.Authenticated
+	event.WatchVersion = watch.Version
+
+	if previous != nil {
+		previousStatus := previous.Status
+		if !previous.Authenticated {
+			event.PreviousActor = previous.Actor
+		}
+		event.PreviousStatus = &previousStatus
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return stub.SetEvent(eventType, payload)
+}
+
+// emit_batch_event sets the summary event of the function passed, that changed the watches with the serials passed
+func (t *SimpleChaincode) emit_batch_event(stub shim.ChaincodeStubInterface, function string, serials []string) error {
+
+	txTime, err := txTimestamp(stub)
+	if err != nil {
+		return err
+	}
+
+	var event WatchBatchEvent
+	event.Version = watchEventVersion
+	event.Type = watchBatchEventTypes[function]
+	event.TxID = stub.GetTxID()
+	event.Timestamp = txTime.Format(time.RFC3339Nano)
+	event.Serials = serials
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return stub.SetEvent(event.Type, payload)
+}
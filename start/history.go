@@ -0,0 +1,139 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"time"
+)
+
+// HistoryEntry records a change of a watch: the invoke function that made it, who called it and when, and the
+// actor and status before and after the change. PreviousStatus is omitted for the creation of the watch.
+type HistoryEntry struct {
+	Function string 		`json:"function"`
+	Caller string 			`json:"caller"`
+	TxID string 			`json:"txId"`
+	Timestamp string 		`json:"timestamp"`
+	PreviousActor string 	`json:"previousActor"`
+	PreviousStatus *int 	`json:"previousStatus,omitempty"`
+	Actor string 			`json:"actor"`
+	Status int 				`json:"status"`
+}
+
+//==============================================================================================================================
+//	 append_history - Stores an immutable entry in the history of the watch. Entries are never rewritten: each one
+//					  has its own key, ordered by transaction timestamp within the serial.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) append_history(stub shim.ChaincodeStubInterface, function string, serial string, previous *Watch, watch Watch) error {
+
+	txTime, err := txTimestamp(stub)
+	if err != nil {
+		return err
+	}
+
+	caller, err := t.get_username(stub)
+	if err != nil {
+		fmt.Println("caller not resolved for the history of " + serial + ": ", err)
+		caller = ""
+	}
+
+	var entry HistoryEntry
+	entry.Function = function
+	entry.Caller = caller
+	entry.TxID = stub.GetTxID()
+	entry.Timestamp = txTime.Format(time.RFC3339Nano)
+	entry.Actor = watch.Actor
+	entry.Status = watch.Status
+
+	if previous != nil {
+		previousStatus := previous.Status
+		entry.PreviousActor = previous.Actor
+		entry.PreviousStatus = &previousStatus
+	}
+
+	jsonAsBytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	//la chiave ordina le voci per timestamp della transazione all'interno del seriale
+	key := ledgerKey(entityHistory, serial, fmt.Sprintf("%020d", txTime.UnixNano()), entry.TxID)
+
+	return stub.PutState(key, jsonAsBytes)
+}
+
+// watchHistory returns the chain of custody of the watch, oldest change first. The supply chain, the auditors and the
+// current owner can read it.
+func (t *SimpleChaincode) watchHistory (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting serial")
+	}
+
+	serial := args[0]
+
+	watch, err := t.get_watch(stub, serial)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.get_viewer(stub).viewLevel(watch) == viewPublic {
+		return nil, errorResponse("00006", "caller not authorized to read the history of the watch")
+	}
+
+	entries, err := t.scan_index(stub, historyRange(serial))
+	if err != nil {
+		return nil, err
+	}
+
+	history := []HistoryEntry{}
+	for _, entryAsString := range entries {
+		var entry HistoryEntry
+		err = json.Unmarshal([]byte(entryAsString), &entry)
+		if err != nil {
+			return nil, errors.New("Corrupted history entry for watch " + serial)
+		}
+		history = append(history, entry)
+	}
+
+	jsonAsBytes, err := json.Marshal(history)
+	if err != nil {
+		return nil, err
+	}
+
+	return jsonAsBytes, nil
+}
+
+// historyRange is the prefix shared by the history entries of the watch
+func historyRange(serial string) string {
+	return keyRange(entityHistory, serial)
+}
+
+// txTimestamp returns the timestamp of the transaction, the same on every peer
+func txTimestamp(stub shim.ChaincodeStubInterface) (time.Time, error) {
+
+	timestamp, err := stub.GetTxTimestamp()
+	if err != nil || timestamp == nil {
+		return time.Time{}, errors.New("Failed to get transaction timestamp")
+	}
+
+	return time.Unix(timestamp.Seconds, int64(timestamp.Nanos)).UTC(), nil
+}
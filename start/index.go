@@ -0,0 +1,306 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"encoding/base64"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ogni orologio ha una propria voce nell'indice, con chiave entityWatchIndex + seriale
+var watchIndexPrefix = keyRange(entityWatchIndex)
+
+// dimensione delle pagine restituite dalle query paginate
+var defaultPageSize = 100
+var maxPageSize = 1000
+
+// IndexPage is a page of the values of an index, in key order. NextBookmark is empty on the last page, Total is
+// only counted for the first page.
+type IndexPage struct {
+	Values []string
+	NextBookmark string
+	Total *int
+}
+
+//==============================================================================================================================
+//	 Watch index - every watch has its own index entry, so that checking a serial is a single GetState and creating
+//				   a watch does not rewrite a shared key. Listing the watches is a range scan over the prefix.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) index_watch(stub shim.ChaincodeStubInterface, serial string) error {
+	return stub.PutState(ledgerKey(entityWatchIndex, serial), []byte(serial))
+}
+
+// is_indexed_watch tells whether the key passed is the serial of an indexed watch
+func (t *SimpleChaincode) is_indexed_watch(stub shim.ChaincodeStubInterface, serial string) (bool, error) {
+
+	entry, err := stub.GetState(ledgerKey(entityWatchIndex, serial))
+	if err != nil {
+		return false, errors.New("Failed to get watch index")
+	}
+
+	return entry != nil, nil
+}
+
+// list_watch_serials returns the serials of all the indexed watches, in key order
+func (t *SimpleChaincode) list_watch_serials(stub shim.ChaincodeStubInterface) ([]string, error) {
+	return t.scan_index(stub, watchIndexPrefix)
+}
+
+// clear_watch_index removes every entry of the watch index and of the secondary indexes, the watches themselves
+// are left untouched
+func (t *SimpleChaincode) clear_watch_index(stub shim.ChaincodeStubInterface) error {
+
+	for _, entityType := range []string{ entityWatchIndex, entityWatchByModel, entityWatchByActor, entityWatchByStatus, entityWatchByProgram } {
+		err := t.clear_prefix(stub, keyRange(entityType))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// clear_prefix deletes every key starting with the prefix
+func (t *SimpleChaincode) clear_prefix(stub shim.ChaincodeStubInterface, prefix string) error {
+
+	keys, err := t.scan_keys(stub, prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		err = stub.DelState(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scan_keys returns the keys stored under the prefix. The scan is complete before the caller changes any of them.
+func (t *SimpleChaincode) scan_keys(stub shim.ChaincodeStubInterface, prefix string) ([]string, error) {
+
+	keysIter, err := stub.RangeQueryState(prefix, rangeEnd(prefix))
+	if err != nil {
+		return nil, errors.New("Failed to scan index " + prefix)
+	}
+	defer keysIter.Close()
+
+	keys := []string{}
+	for keysIter.HasNext() {
+		key, _, err := keysIter.Next()
+		if err != nil {
+			return nil, errors.New("Failed to scan index " + prefix)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+//==============================================================================================================================
+//	 update_secondary_indexes - Moves the entries of the watch in the model, actor, status and program indexes from the
+//								values of the previous record (nil for a new watch) to the values of the one being
+//								written. A watch has one entry per program it is enrolled in.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) update_secondary_indexes(stub shim.ChaincodeStubInterface, serial string, previous *Watch, watch Watch) error {
+
+	var oldValues []string
+	if previous != nil {
+		oldValues = secondaryIndexKeys(serial, *previous)
+	}
+	newValues := secondaryIndexKeys(serial, watch)
+
+	for _, oldValue := range oldValues {
+		if stringInSlice(oldValue, newValues) {
+			continue
+		}
+
+		err := stub.DelState(oldValue)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, newValue := range newValues {
+		if stringInSlice(newValue, oldValues) {
+			continue
+		}
+
+		err := stub.PutState(newValue, []byte(serial))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func secondaryIndexKeys(serial string, watch Watch) []string {
+
+	keys := []string{
+		ledgerKey(entityWatchByModel, watch.Model, serial),
+		ledgerKey(entityWatchByActor, watch.Actor, serial),
+		ledgerKey(entityWatchByStatus, strconv.Itoa(watch.Status), serial),
+	}
+
+	for _, loyalty := range watch.Loyalties {
+		if len(loyalty.ProgramId) > 0 {
+			keys = append(keys, ledgerKey(entityWatchByProgram, loyalty.ProgramId, serial))
+		}
+	}
+
+	return keys
+}
+
+// secondaryIndexRange is the prefix shared by the entries of the secondary index of the watches having the value passed
+func secondaryIndexRange(entityType string, value string) string {
+	return keyRange(entityType, value)
+}
+
+// scan_index returns the values of all the index entries stored under the prefix, in key order
+func (t *SimpleChaincode) scan_index(stub shim.ChaincodeStubInterface, prefix string) ([]string, error) {
+
+	keysIter, err := stub.RangeQueryState(prefix, rangeEnd(prefix))
+	if err != nil {
+		return nil, errors.New("Failed to scan index " + prefix)
+	}
+	defer keysIter.Close()
+
+	values := []string{}
+	for keysIter.HasNext() {
+		_, value, err := keysIter.Next()
+		if err != nil {
+			return nil, errors.New("Failed to scan index " + prefix)
+		}
+		values = append(values, string(value))
+	}
+
+	return values, nil
+}
+
+//==============================================================================================================================
+//	 page_index - Returns a page of at most pageSize values of the index stored under the prefix, starting after the
+//				  bookmark returned with the previous page (empty for the first page). Bookmarks are the opaque
+//				  encoding of the last key returned, so the order is stable across pages. Counting the entries takes
+//				  a scan of the whole index, so the total is returned with the first page only.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) page_index(stub shim.ChaincodeStubInterface, prefix string, pageSize int, bookmark string) (IndexPage, error) {
+
+	var page IndexPage
+	page.Values = []string{}
+
+	startKey := prefix
+	if len(bookmark) > 0 {
+		lastKey, err := base64.URLEncoding.DecodeString(bookmark)
+		if err != nil || !strings.HasPrefix(string(lastKey), prefix) {
+			return page, errorResponse("00016", "invalid bookmark")
+		}
+		startKey = string(lastKey) + "\x00"
+	}
+
+	keysIter, err := stub.RangeQueryState(startKey, rangeEnd(prefix))
+	if err != nil {
+		return page, errors.New("Failed to scan index " + prefix)
+	}
+	defer keysIter.Close()
+
+	var lastKey string
+	for keysIter.HasNext() {
+		key, value, err := keysIter.Next()
+		if err != nil {
+			return page, errors.New("Failed to scan index " + prefix)
+		}
+
+		if len(page.Values) == pageSize {
+			page.NextBookmark = base64.URLEncoding.EncodeToString([]byte(lastKey))
+			break
+		}
+
+		page.Values = append(page.Values, string(value))
+		lastKey = key
+	}
+
+	if len(bookmark) == 0 {
+		total, err := t.count_index(stub, prefix)
+		if err != nil {
+			return page, err
+		}
+		page.Total = &total
+	}
+
+	return page, nil
+}
+
+// count_index returns the number of entries of the index stored under the prefix
+func (t *SimpleChaincode) count_index(stub shim.ChaincodeStubInterface, prefix string) (int, error) {
+
+	keysIter, err := stub.RangeQueryState(prefix, rangeEnd(prefix))
+	if err != nil {
+		return 0, errors.New("Failed to scan index " + prefix)
+	}
+	defer keysIter.Close()
+
+	total := 0
+	for keysIter.HasNext() {
+		_, _, err := keysIter.Next()
+		if err != nil {
+			return 0, errors.New("Failed to scan index " + prefix)
+		}
+		total++
+	}
+
+	return total, nil
+}
+
+// parsePageArgs reads the optional page size and bookmark arguments found from position first on
+func parsePageArgs(args []string, first int) (int, string, error) {
+
+	pageSize := defaultPageSize
+	bookmark := ""
+
+	if len(args) > first + 2 {
+		return 0, "", errors.New("Incorrect number of arguments. Expecting optional page size and bookmark")
+	}
+
+	if len(args) > first && len(args[first]) > 0 {
+		size, err := strconv.Atoi(args[first])
+		if err != nil || size <= 0 || size > maxPageSize {
+			return 0, "", errors.New("Page size must be a number between 1 and " + strconv.Itoa(maxPageSize))
+		}
+		pageSize = size
+	}
+
+	if len(args) > first + 1 {
+		bookmark = args[first + 1]
+	}
+
+	return pageSize, bookmark, nil
+}
+
+// rangeEnd is the end key of a range scan covering every key starting with the prefix
+func rangeEnd(prefix string) string {
+	return prefix + string(utf8.MaxRune)
+}
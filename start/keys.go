@@ -0,0 +1,68 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+)
+
+//==============================================================================================================================
+//	 Key layout - every entity is stored under its type followed by its identifiers, joined by keySeparator, so that
+//				  entities of different types can never collide (a watch serial equal to a user name, for instance)
+//				  and all the entities of a type can be scanned as a range. Every GetState/PutState goes through
+//				  ledgerKey, range scans through keyRange. Watches stored under their bare serial by the original
+//				  version of the chaincode are moved to this layout by migrate_watch_index.
+//==============================================================================================================================
+
+// tipi di entità salvate sul ledger
+const (
+	entityWatch			= "watch"
+	entityActor			= "actor"
+	entityUser			= "user"
+	entityECert			= "ecert"
+	entityProgram		= "program"
+	entityIndex			= "index"
+	entityWatchIndex	= "watchindex"
+	entityWatchByModel	= "watchbymodel"
+	entityWatchByActor	= "watchbyactor"
+	entityWatchByStatus	= "watchbystatus"
+	entityWatchByProgram	= "watchbyprogram"
+	entityHistory		= "history"
+)
+
+var keySeparator = "\x00"
+
+// entità che la query read può restituire
+var readableEntities = []string{ entityWatch, entityActor, entityUser, entityProgram }
+
+// ledgerKey is the key of the entity of the given type with the identifiers passed
+func ledgerKey(entityType string, ids ...string) string {
+	return entityType + keySeparator + strings.Join(ids, keySeparator)
+}
+
+// keyRange is the prefix shared by the keys of the entities of the given type starting with the identifiers passed
+func keyRange(entityType string, ids ...string) string {
+	if len(ids) == 0 {
+		return entityType + keySeparator
+	}
+	return ledgerKey(entityType, ids...) + keySeparator
+}
+
+// validKeyId tells whether the identifier can be used in a key
+func validKeyId(id string) bool {
+	return len(id) > 0 && !strings.Contains(id, keySeparator)
+}
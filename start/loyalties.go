@@ -0,0 +1,240 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Loyalty lifecycle - a loyalty is added pending (addLoyalty) and addressed afterwards by its id, stable for the life
+//						 of the watch. Its Status follows:
+//
+//		pending   --activate_loyalty-->  active  --redeem_loyalty-->  redeemed
+//		pending, active  --cancel_loyalty-->  cancelled
+//		pending, active  -- the day after endDate -->  expired
+//
+//	 Expiry is not written by any invoke: it is evaluated against the date of the transaction (of the query in
+//	 loyalties_per_watch), so a loyalty past its endDate is expired even if its stored status is still active.
+//	 A loyalty can be redeemed only between startDate and endDate. Dates are compared as UTC days.
+//
+//	 Loyalties added before the lifecycle are marked Legacy when they get their id: their stored status predates
+//	 the lifecycle, so it is reported as it is and never expired. They count as pending for activate_loyalty and
+//	 cancel_loyalty, which bring them into the lifecycle; activation requires valid dates. A loyalty whose endDate
+//	 is not a valid date never expires.
+//==============================================================================================================================
+
+const (
+	loyaltyPending		= 0
+	loyaltyActive		= 1
+	loyaltyExpired		= 2
+	loyaltyCancelled	= 3
+	loyaltyRedeemed		= 4
+)
+
+var loyaltyStatusNames = map[int]string{
+	loyaltyPending: 	"pending",
+	loyaltyActive: 		"active",
+	loyaltyExpired: 	"expired",
+	loyaltyCancelled: 	"cancelled",
+	loyaltyRedeemed: 	"redeemed",
+}
+
+func (t *SimpleChaincode) activateLoyalty (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return t.change_loyalty(stub, "activate_loyalty", args, []int{ loyaltyPending }, loyaltyActive)
+}
+
+func (t *SimpleChaincode) cancelLoyalty (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return t.change_loyalty(stub, "cancel_loyalty", args, []int{ loyaltyPending, loyaltyActive }, loyaltyCancelled)
+}
+
+func (t *SimpleChaincode) redeemLoyalty (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return t.change_loyalty(stub, "redeem_loyalty", args, []int{ loyaltyActive }, loyaltyRedeemed)
+}
+
+//==============================================================================================================================
+//	 change_loyalty - Moves the loyalty of the watch to the status passed, if its status at the date of the transaction
+//					  is one of those allowed. Args are serial, loyalty id and optionally the expected watch version.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) change_loyalty (stub shim.ChaincodeStubInterface, function string, args []string, from []int, to int) ([]byte, error) {
+
+	args, expected, err := expectedVersion(args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting serial and loyalty id")
+	}
+
+	var serial = args[0]
+	var loyaltyId = args[1]
+
+	fmt.Println("running " + function + "() for the loyalty " + loyaltyId + " of the watch with serial: " + serial)
+
+	watch, err := t.get_watch(stub, serial)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkVersion(serial, watch, expected)
+	if err != nil {
+		return nil, err
+	}
+
+	i, found := findLoyalty(watch, loyaltyId)
+	if !found {
+		return nil, errorResponse("00024", "no loyalty " + loyaltyId + " for watch " + serial)
+	}
+
+	txTime, err := txTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	loyalty := watch.Loyalties[i]
+	status := loyaltyStatusAt(loyalty, txTime)
+
+	if loyalty.Legacy {
+		//una loyalty precedente al ciclo di vita entra nel ciclo come pending, se le sue date sono valide
+		loyalty.Legacy = false
+		loyalty.Status = loyaltyPending
+		status = loyaltyStatusAt(loyalty, txTime)
+
+		if to == loyaltyActive && !validLoyaltyDates(loyalty) {
+			return nil, errorResponse("00025", "loyalty " + loyaltyId + " has no valid dates, it can not be activated")
+		}
+	}
+
+	allowed := false
+	for _, s := range from {
+		if s == status {
+			allowed = true
+		}
+	}
+
+	if !allowed {
+		return nil, errorResponse("00025", "loyalty " + loyaltyId + " is " + loyaltyStatusName(status) + ", " + function + " is not allowed")
+	}
+
+	if to == loyaltyRedeemed {
+		startDate, err := time.Parse(dateLayout, loyalty.StartDate)
+		if err != nil || txTime.Before(startDate) {
+			return nil, errorResponse("00025", "loyalty " + loyaltyId + " can not be redeemed before its start date " + loyalty.StartDate)
+		}
+	}
+
+	watch.Loyalties[i].Legacy = false
+	watch.Loyalties[i].Status = to
+
+	err = t.put_watch(stub, function, serial, watch)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// findLoyalty returns the position of the loyalty with the id passed among those of the watch
+func findLoyalty(watch Watch, loyaltyId string) (int, bool) {
+	for i, loyalty := range watch.Loyalties {
+		if loyalty.Id == loyaltyId {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// nextLoyaltyId is the first sequential id not yet used by the loyalties of the watch
+func nextLoyaltyId(watch Watch) string {
+	for n := len(watch.Loyalties) + 1; ; n++ {
+		if _, found := findLoyalty(watch, strconv.Itoa(n)); !found {
+			return strconv.Itoa(n)
+		}
+	}
+}
+
+// assignLoyaltyIds gives an id to the loyalties added before ids existed, from their position in the watch, and
+// marks them Legacy. The ids are written with the next change of the watch.
+func assignLoyaltyIds(watch *Watch) {
+	for i := range watch.Loyalties {
+		if len(watch.Loyalties[i].Id) > 0 {
+			continue
+		}
+		id := strconv.Itoa(i + 1)
+		if _, found := findLoyalty(*watch, id); found {
+			id = nextLoyaltyId(*watch)
+		}
+		watch.Loyalties[i].Id = id
+		watch.Loyalties[i].Legacy = true
+	}
+}
+
+// loyaltyStatusAt is the status of the loyalty at the time passed, taking expiry into account. Legacy loyalties and
+// loyalties without a valid endDate keep their stored status.
+func loyaltyStatusAt(loyalty Loyalty, at time.Time) int {
+
+	if loyalty.Legacy || (loyalty.Status != loyaltyPending && loyalty.Status != loyaltyActive) {
+		return loyalty.Status
+	}
+
+	endDate, err := time.Parse(dateLayout, loyalty.EndDate)
+	if err != nil {
+		return loyalty.Status
+	}
+
+	//la loyalty vale per tutto il giorno di endDate
+	if !at.Before(endDate.AddDate(0, 0, 1)) {
+		return loyaltyExpired
+	}
+
+	return loyalty.Status
+}
+
+// validLoyaltyDates tells whether startDate and endDate are dates, in order
+func validLoyaltyDates(loyalty Loyalty) bool {
+
+	startDate, startErr := time.Parse(dateLayout, loyalty.StartDate)
+	endDate, endErr := time.Parse(dateLayout, loyalty.EndDate)
+
+	return startErr == nil && endErr == nil && !endDate.Before(startDate)
+}
+
+// loyaltyStatusName is the name of the status, or its number for the statuses of legacy loyalties
+func loyaltyStatusName(status int) string {
+	if name, found := loyaltyStatusNames[status]; found {
+		return name
+	}
+	return "in legacy status " + strconv.Itoa(status)
+}
+
+// evaluationTime is the time loyalties are evaluated at: the transaction timestamp, or the peer clock for the
+// queries run without one
+func evaluationTime(stub shim.ChaincodeStubInterface) time.Time {
+
+	txTime, err := txTimestamp(stub)
+	if err != nil {
+		return time.Now().UTC()
+	}
+
+	return txTime
+}
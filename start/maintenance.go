@@ -0,0 +1,240 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// KeyRepair describes a watch whose Serial did not match the key it is stored under
+type KeyRepair struct {
+	Key string 			`json:"key"`
+	Serial string 		`json:"serial"`
+	Merged bool 		`json:"merged"`
+}
+
+//==============================================================================================================================
+//	 repair_watch_keys - Admin function reconciling watches whose Serial diverges from the key they are indexed with.
+//						 Older versions of moveToNextActor wrote the moved watch under watch.Serial, splitting it in two
+//						 records: the progress of the supply chain found in that stray record is merged back into the
+//						 indexed one, the stray record is deleted and Serial is set to the key. Returns the repairs done.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) repairWatchKeys (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting no arguments")
+	}
+
+	watchIndex, err := t.list_watch_serials(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	repairs := []KeyRepair{}
+	repaired := []string{}
+	for _, key := range watchIndex {
+
+		watch, found, err := t.find_watch(stub, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if !found || watch.Serial == key {
+			continue
+		}
+
+		repair := KeyRepair{ Key: key, Serial: watch.Serial }
+
+		//il record scritto sotto watch.Serial (chiave piatta, precedente al layout per entità) è quello più avanti
+		//nella filiera, se non è a sua volta un orologio indicizzato
+		strayIndexed, err := t.is_indexed_watch(stub, watch.Serial)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(watch.Serial) > 0 && !strayIndexed {
+
+			strayAsBytes, err := stub.GetState(watch.Serial)
+			if err != nil {
+				return nil, errors.New("Failed to get state for " + watch.Serial)
+			}
+
+			var stray Watch
+			if strayAsBytes != nil && json.Unmarshal(strayAsBytes, &stray) == nil && stray.Serial == watch.Serial {
+
+				if stray.Status > watch.Status {
+					watch.Actor = stray.Actor
+					watch.Status = stray.Status
+				}
+
+				err = stub.DelState(watch.Serial)
+				if err != nil {
+					return nil, err
+				}
+
+				repair.Merged = true
+			}
+		}
+
+		watch.Serial = key
+
+		err = t.put_watch(stub, "repair_watch_keys", key, watch)
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Println("repaired watch " + key + " stored with serial " + repair.Serial)
+		repairs = append(repairs, repair)
+		repaired = append(repaired, key)
+	}
+
+	if len(repaired) > 0 {
+		err = t.emit_batch_event(stub, "repair_watch_keys", repaired)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	jsonAsBytes, err := json.Marshal(repairs)
+	if err != nil {
+		return nil, err
+	}
+
+	return jsonAsBytes, nil
+}
+
+//==============================================================================================================================
+//	 migrate_watch_index - Admin function converting the legacy _watchindex json array into one index entry per watch.
+//						   The legacy array is deleted once every serial has been indexed, the watches still stored under
+//						   their bare serial are moved to their namespaced key and the secondary indexes by model, actor
+//						   and status are built for the migrated watches. Returns the migrated serials.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) migrateWatchIndex (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting no arguments")
+	}
+
+	watchIndexAsBytes, err := stub.GetState(watchIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get watch index")
+	}
+
+	var watchIndex []string
+	if watchIndexAsBytes != nil {
+		err = json.Unmarshal(watchIndexAsBytes, &watchIndex)
+		if err != nil {
+			return nil, errors.New("Legacy watch index is not a json array")
+		}
+	}
+
+	migrated := []string{}
+	for _, serial := range watchIndex {
+		err = t.index_watch(stub, serial)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = t.move_flat_watch(stub, serial)
+		if err != nil {
+			return nil, err
+		}
+
+		watch, found, err := t.find_watch(stub, serial)
+		if err != nil {
+			return nil, err
+		}
+
+		if found {
+			err = t.update_secondary_indexes(stub, serial, nil, watch)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		migrated = append(migrated, serial)
+	}
+
+	err = stub.DelState(watchIndexStr)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("migrated ", len(migrated), " watches to the new index")
+
+	jsonAsBytes, err := json.Marshal(migrated)
+	if err != nil {
+		return nil, err
+	}
+
+	return jsonAsBytes, nil
+}
+
+// move_flat_watch moves the watch stored under the bare indexed serial to its namespaced key, unless the namespaced
+// key is already taken. The Serial of the record may differ from the key: repair_watch_keys reconciles it afterwards.
+// Values that are not a json watch (an eCert of a user with the same name) are left alone.
+func (t *SimpleChaincode) move_flat_watch (stub shim.ChaincodeStubInterface, serial string) (bool, error) {
+
+	flatAsBytes, err := stub.GetState(serial)
+	if err != nil {
+		return false, errors.New("Failed to get state for " + serial)
+	}
+
+	var watch Watch
+	if flatAsBytes == nil || json.Unmarshal(flatAsBytes, &watch) != nil {
+		return false, nil
+	}
+
+	return t.move_state(stub, serial, ledgerKey(entityWatch, serial))
+}
+
+// move_state moves the value stored under oldKey to newKey, unless newKey is already taken
+func (t *SimpleChaincode) move_state (stub shim.ChaincodeStubInterface, oldKey string, newKey string) (bool, error) {
+
+	valAsBytes, err := stub.GetState(oldKey)
+	if err != nil {
+		return false, errors.New("Failed to get state for " + oldKey)
+	}
+	if valAsBytes == nil {
+		return false, nil
+	}
+
+	newAsBytes, err := stub.GetState(newKey)
+	if err != nil {
+		return false, errors.New("Failed to get state for " + newKey)
+	}
+
+	//il valore già presente nel nuovo layout è più recente: il vecchio viene solo eliminato
+	if newAsBytes == nil {
+		err = stub.PutState(newKey, valAsBytes)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = stub.DelState(oldKey)
+	if err != nil {
+		return false, err
+	}
+
+	return newAsBytes == nil, nil
+}
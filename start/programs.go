@@ -0,0 +1,330 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Loyalty catalog - the programs shared across watches (a brand-wide warranty extension, for instance) are defined
+//					   once with create_program and update_program. enroll_watch adds to a watch a loyalty referring
+//					   to the program by ProgramId: type and description are read from the program, so a change of the
+//					   program applies to every enrolled watch, while the dates and the lifecycle (see loyalties.go)
+//					   are those of the single enrolment. watches_by_program lists the enrolled watches to the
+//					   supply chain and the auditors.
+//
+//		{ "id": "warranty-ext", "type": "warranty", "description": "...", "durationDays": 730,
+//		  "eligibility": { "models": ["M1", "M2"], "actors": ["..."] }, "active": true }
+//
+//	 A watch is eligible when its model is among the models and its current actor among the actors of the program;
+//	 an empty list does not restrict. Programs no longer active accept no new enrolments.
+//==============================================================================================================================
+
+type LoyaltyProgram struct {
+	Id string 						`json:"id"`
+	Type string 					`json:"type"`
+	Description string 				`json:"description"`
+	DurationDays int 				`json:"durationDays"`
+	Eligibility ProgramEligibility 	`json:"eligibility"`
+	Active bool 					`json:"active"`
+}
+
+type ProgramEligibility struct {
+	Models []string 	`json:"models,omitempty"`
+	Actors []string 	`json:"actors,omitempty"`
+}
+
+// createProgram adds a program to the catalog, args are the json of the program
+func (t *SimpleChaincode) createProgram (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting program")
+	}
+
+	program, err := unmarshProgramJson([]byte(args[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("running createProgram() - program: " + program.Id)
+
+	_, found, err := t.find_program(stub, program.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if found {
+		return nil, errorResponse("00026", "loyalty program " + program.Id + " already exists")
+	}
+
+	err = t.put_program(stub, program)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end create new program")
+
+	return nil, nil
+}
+
+// updateProgram replaces the definition of a program, args are the program id and its json
+func (t *SimpleChaincode) updateProgram (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting program id and program")
+	}
+
+	program, err := unmarshProgramJson([]byte(args[1]))
+	if err != nil {
+		return nil, err
+	}
+
+	if program.Id != args[0] {
+		return nil, errorResponse("00015", "program id " + program.Id + " does not match the key " + args[0])
+	}
+
+	_, err = t.get_program(stub, program.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.put_program(stub, program)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end update program " + program.Id)
+
+	return nil, nil
+}
+
+func (t *SimpleChaincode) readAllPrograms (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting no arguments")
+	}
+
+	programsAsBytes, err := t.scan_index(stub, keyRange(entityProgram))
+	if err != nil {
+		return nil, err
+	}
+
+	allPrograms := []LoyaltyProgram{}
+	for _, programAsBytes := range programsAsBytes {
+		var program LoyaltyProgram
+		err = json.Unmarshal([]byte(programAsBytes), &program)
+		if err != nil {
+			return nil, err
+		}
+		allPrograms = append(allPrograms, program)
+	}
+
+	jsonAsBytes, err := json.Marshal(allPrograms)
+	if err != nil {
+		return nil, err
+	}
+
+	return jsonAsBytes, nil
+}
+
+//==============================================================================================================================
+//	 enroll_watch - Enrols an eligible watch in an active program, args are serial, program id and optionally the
+//					expected watch version. The loyalty is added pending, from the date of the transaction for the
+//					duration of the program. A watch can be enrolled only once in the same program.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) enrollWatch (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	args, expected, err := expectedVersion(args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting serial and program id")
+	}
+
+	var serial = args[0]
+	var programId = args[1]
+
+	fmt.Println("running enrollWatch() for the watch with serial: " + serial + " in program " + programId)
+
+	watch, err := t.get_watch(stub, serial)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkVersion(serial, watch, expected)
+	if err != nil {
+		return nil, err
+	}
+
+	program, err := t.get_program(stub, programId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !program.Active {
+		return nil, errorResponse("00028", "loyalty program " + programId + " is not active")
+	}
+
+	if !program.eligible(watch) {
+		return nil, errorResponse("00028", "watch " + serial + " is not eligible for loyalty program " + programId)
+	}
+
+	for _, loyalty := range watch.Loyalties {
+		if loyalty.ProgramId == programId {
+			return nil, errorResponse("00028", "watch " + serial + " already enrolled in loyalty program " + programId)
+		}
+	}
+
+	txTime, err := txTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var loyalty Loyalty
+	loyalty.Id = nextLoyaltyId(watch)
+	loyalty.ProgramId = programId
+	loyalty.Status = loyaltyPending
+	loyalty.StartDate = txTime.Format(dateLayout)
+	loyalty.EndDate = txTime.AddDate(0, 0, program.DurationDays).Format(dateLayout)
+
+	watch.Loyalties = append(watch.Loyalties, loyalty)
+
+	err = t.put_watch(stub, "enroll_watch", serial, watch)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// eligible tells whether the watch satisfies the eligibility rules of the program
+func (p LoyaltyProgram) eligible(watch Watch) bool {
+
+	if len(p.Eligibility.Models) > 0 && !stringInSlice(watch.Model, p.Eligibility.Models) {
+		return false
+	}
+
+	if len(p.Eligibility.Actors) > 0 && !stringInSlice(watch.Actor, p.Eligibility.Actors) {
+		return false
+	}
+
+	return true
+}
+
+// resolve_programs fills type and description of the loyalties referring to a program with those of the catalog
+func (t *SimpleChaincode) resolve_programs(stub shim.ChaincodeStubInterface, loyalties []Loyalty) error {
+
+	for i := range loyalties {
+		if len(loyalties[i].ProgramId) == 0 {
+			continue
+		}
+
+		program, err := t.get_program(stub, loyalties[i].ProgramId)
+		if err != nil {
+			return err
+		}
+
+		loyalties[i].Type = program.Type
+		loyalties[i].Description = program.Description
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 get_program - Reads a program from the catalog, failing with code 00027 if it does not exist.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) get_program(stub shim.ChaincodeStubInterface, id string) (LoyaltyProgram, error) {
+
+	program, found, err := t.find_program(stub, id)
+	if err != nil {
+		return program, err
+	}
+
+	if !found {
+		return program, errorResponse("00027", "loyalty program " + id + " does not exist")
+	}
+
+	return program, nil
+}
+
+func (t *SimpleChaincode) find_program(stub shim.ChaincodeStubInterface, id string) (LoyaltyProgram, bool, error) {
+
+	var program LoyaltyProgram
+
+	programAsBytes, err := stub.GetState(ledgerKey(entityProgram, id))
+	if err != nil {
+		return program, false, errors.New("Failed to get loyalty program " + id)
+	}
+
+	if programAsBytes == nil {
+		return program, false, nil
+	}
+
+	err = json.Unmarshal(programAsBytes, &program)
+	if err != nil {
+		return program, false, err
+	}
+
+	return program, true, nil
+}
+
+func (t *SimpleChaincode) put_program(stub shim.ChaincodeStubInterface, program LoyaltyProgram) error {
+
+	jsonAsBytes, err := json.Marshal(program)
+	if err != nil {
+		return err
+	}
+
+	return stub.PutState(ledgerKey(entityProgram, program.Id), jsonAsBytes)
+}
+
+// unmarshProgramJson decodes and validates the json of a program
+func unmarshProgramJson(jsonAsByte []byte) (LoyaltyProgram, error) {
+
+	var program LoyaltyProgram
+
+	err := decodeStrict(jsonAsByte, &program)
+	if err != nil {
+		return program, validationError([]FieldError{ decodeFieldError(err) })
+	}
+
+	var fields []FieldError
+	if !validKeyId(program.Id) {
+		fields = append(fields, FieldError{ Field: "id", Error: "required, must not contain NUL characters" })
+	}
+	fields = requireField(fields, "type", program.Type)
+
+	//la durata massima evita date di fine non rappresentabili come anno a quattro cifre
+	if program.DurationDays <= 0 || program.DurationDays > 36500 {
+		fields = append(fields, FieldError{ Field: "durationDays", Error: "must be between 1 and 36500" })
+	}
+
+	if len(fields) > 0 {
+		return program, validationError(fields)
+	}
+
+	return program, nil
+}
@@ -0,0 +1,149 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Role is the affiliation of a participant of the network. On the ledger and in the json responses a role is
+// written by name; the numeric form is the one encoded in the certificates and is still accepted when parsing.
+type Role int
+
+const (
+	noRole			Role = 0
+	manifacturer 	Role = 1
+	distributor 	Role = 2
+	retailer		Role = 3
+	auditor			Role = 4
+	customer		Role = 5
+)
+
+var roleNames = map[Role]string{
+	manifacturer: 	"manifacturer",
+	distributor: 	"distributor",
+	retailer: 		"retailer",
+	auditor: 		"auditor",
+	customer: 		"customer",
+}
+
+// ruolo che deve detenere l'orologio in ciascuno stato della filiera
+var statusRoles = map[int]Role{
+	statusAtManifacturer: 	manifacturer,
+	statusAtDistributor: 	distributor,
+	statusAtRetailer: 		retailer,
+}
+
+func (r Role) String() string {
+	name, found := roleNames[r]
+	if !found {
+		return "unknown(" + strconv.Itoa(int(r)) + ")"
+	}
+	return name
+}
+
+func (r Role) isValid() bool {
+	_, found := roleNames[r]
+	return found
+}
+
+// isSupplyChain tells whether the role is one of the actors the watch moves through before reaching a customer
+func (r Role) isSupplyChain() bool {
+	return r == manifacturer || r == distributor || r == retailer
+}
+
+// parseRole reads a role either by name or in the numeric form encoded in the certificates
+func parseRole(value string) (Role, error) {
+
+	value = strings.TrimSpace(value)
+
+	number, err := strconv.Atoi(value)
+	if err == nil {
+		role := Role(number)
+		if !role.isValid() {
+			return noRole, errorResponse("00009", "invalid role " + value)
+		}
+		return role, nil
+	}
+
+	name := strings.ToLower(value)
+	if name == "manufacturer" {
+		name = "manifacturer"
+	}
+
+	for role, roleName := range roleNames {
+		if roleName == name {
+			return role, nil
+		}
+	}
+
+	return noRole, errorResponse("00009", "invalid role " + value)
+}
+
+func (r Role) MarshalJSON() ([]byte, error) {
+	if !r.isValid() {
+		return nil, errors.New("Invalid role " + strconv.Itoa(int(r)))
+	}
+	return json.Marshal(r.String())
+}
+
+// UnmarshalJSON accepts the role name, as well as the numeric form stored by older versions of the chaincode either
+// as a number or as a string
+func (r *Role) UnmarshalJSON(data []byte) error {
+
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		var number int
+		err = json.Unmarshal(data, &number)
+		if err != nil {
+			return errors.New("Role must be a name or a number")
+		}
+		value = strconv.Itoa(number)
+	}
+
+	role, err := parseRole(value)
+	if err != nil {
+		return errors.New("Invalid role " + value)
+	}
+
+	*r = role
+	return nil
+}
+
+// statusRole returns the role expected to hold a watch in the supply chain status passed
+func statusRole(status int) (Role, bool) {
+	role, found := statusRoles[status]
+	return role, found
+}
+
+// holderRole returns the role expected to hold the watch: the customer once authenticated, otherwise the supply chain
+// actor matching its status
+func holderRole(watch Watch) Role {
+	if watch.Authenticated {
+		return customer
+	}
+
+	role, found := statusRole(watch.Status)
+	if !found {
+		return noRole
+	}
+	return role
+}
@@ -0,0 +1,226 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Ownership transfer - once authenticated, a watch can be resold in two steps: the current owner offers it to a
+//						  new customer proving knowledge of the secret and fixing a one-time transfer token
+//						  (offer_transfer), then hands the token to the new customer, who accepts the watch proving
+//						  knowledge of the token and choosing a new secret (accept_transfer). Only the salted hash of
+//						  the token is stored, as for the secret. Until then the owner can withdraw the offer
+//						  (cancel_transfer).
+//==============================================================================================================================
+
+func (t *SimpleChaincode) offerTransfer (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	args, expected, err := expectedVersion(args, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting serial, secret, new owner and transfer token")
+	}
+
+	var serial = args[0]
+	var secret = args[1]
+	var newOwner = args[2]
+	var token = args[3]
+
+	fmt.Println("running offerTransfer() for the watch with serial: " + serial)
+
+	watch, err := t.get_watch(stub, serial)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkVersion(serial, watch, expected)
+	if err != nil {
+		return nil, err
+	}
+
+	if watch.Authenticated == false {
+		return nil, errorResponse("00013", "watch not authenticated, it can not be transferred")
+	}
+
+	if !matchSecret(watch, secret) {
+		return nil, errorResponse("00002", "no secret or incorrect secret")
+	}
+
+	if !validKeyId(newOwner) || newOwner == watch.Actor {
+		return nil, errors.New("New owner must be a customer different from the current owner")
+	}
+
+	if len(token) == 0 {
+		return nil, errors.New("Transfer token can not be empty")
+	}
+
+	watch.Transfer = &Transfer{ From: watch.Actor, To: newOwner }
+	setTransferToken(stub, watch.Transfer, serial, token)
+
+	err = t.put_watch(stub, "offer_transfer", serial, watch)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Watch with serial: " + serial + " offered to " + newOwner)
+
+	return nil, nil
+}
+
+func (t *SimpleChaincode) acceptTransfer (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	args, expected, err := expectedVersion(args, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting serial, new owner, transfer token and new secret")
+	}
+
+	var serial = args[0]
+	var newOwner = args[1]
+	var token = args[2]
+	var newSecret = args[3]
+
+	fmt.Println("running acceptTransfer() for the watch with serial: " + serial)
+
+	if len(newSecret) == 0 {
+		return nil, errors.New("New secret can not be empty")
+	}
+
+	watch, err := t.get_watch(stub, serial)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkVersion(serial, watch, expected)
+	if err != nil {
+		return nil, err
+	}
+
+	if watch.Transfer == nil || watch.Transfer.To != newOwner || watch.Transfer.From != watch.Actor {
+		return nil, errorResponse("00012", "no pending transfer of this watch to " + newOwner)
+	}
+
+	//solo chi ha ricevuto il token dal vecchio proprietario può accettare il passaggio
+	if !matchTransferToken(*watch.Transfer, token) {
+		return nil, errorResponse("00002", "incorrect transfer token")
+	}
+
+	previousOwner := watch.Actor
+
+	//il segreto viene ruotato: il vecchio proprietario non può più dimostrare il possesso
+	watch.Actor = newOwner
+	setSecret(stub, &watch, serial, newSecret)
+	watch.Transfer = nil
+
+	err = t.put_watch(stub, "accept_transfer", serial, watch)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.remove_watch_from_user(stub, previousOwner, serial)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.add_watch_to_user(stub, newOwner, serial)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Watch with serial: " + serial + " transferred from " + previousOwner + " to " + newOwner)
+
+	return nil, nil
+}
+
+func (t *SimpleChaincode) cancelTransfer (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	args, expected, err := expectedVersion(args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting serial and secret")
+	}
+
+	var serial = args[0]
+	var secret = args[1]
+
+	watch, err := t.get_watch(stub, serial)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkVersion(serial, watch, expected)
+	if err != nil {
+		return nil, err
+	}
+
+	if watch.Transfer == nil {
+		return nil, errorResponse("00012", "no pending transfer of this watch")
+	}
+
+	if !matchSecret(watch, secret) {
+		return nil, errorResponse("00002", "no secret or incorrect secret")
+	}
+
+	watch.Transfer = nil
+
+	err = t.put_watch(stub, "cancel_transfer", serial, watch)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Transfer of watch with serial: " + serial + " cancelled")
+
+	return nil, nil
+}
+
+// setTransferToken stores the salted hash of the one-time token the new owner must present to accept the transfer
+func setTransferToken(stub shim.ChaincodeStubInterface, transfer *Transfer, serial string, token string) {
+	salt := sha256.Sum256([]byte(stub.GetTxID() + serial + transfer.To))
+
+	transfer.TokenAlgorithm = secretAlgorithm
+	transfer.TokenSalt = hex.EncodeToString(salt[:])
+	transfer.TokenHash, _ = hashSecret(transfer.TokenAlgorithm, transfer.TokenSalt, token)
+}
+
+func matchTransferToken(transfer Transfer, token string) bool {
+	if len(transfer.TokenHash) == 0 {
+		return false
+	}
+
+	hash, err := hashSecret(transfer.TokenAlgorithm, transfer.TokenSalt, token)
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(transfer.TokenHash)) == 1
+}
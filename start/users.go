@@ -0,0 +1,280 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 User registry - create_user registers a customer, read_user, read_all_users and watches_per_user query the
+//					 registry. User.Watches is kept in sync by authenticateWatch. Every user is listed in the user index,
+//					 see userIndexStr. The queries show a customer only to itself, the supply chain and the auditors.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) createUser (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting customer code")
+	}
+
+	var user User
+	user.CodCliente = args[0]
+	user.Watches = []string{}
+
+	fmt.Println("running createUser() - customer: " + user.CodCliente)
+
+	if !validKeyId(user.CodCliente) {
+		return nil, errors.New("Customer code can not be empty or contain NUL characters")
+	}
+
+	userAsBytes, err := stub.GetState(ledgerKey(entityUser, user.CodCliente))
+	if err != nil {
+		return nil, errors.New("Failed to get user " + user.CodCliente)
+	}
+
+	if userAsBytes != nil {
+		return nil, errorResponse("00010", "user already registered")
+	}
+
+	err = t.put_user(stub, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.add_user_to_index(stub, user.CodCliente)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end create new user")
+
+	return nil, nil
+}
+
+func (t *SimpleChaincode) readUser (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting customer code")
+	}
+
+	user, err := t.get_visible_user(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	jsonAsBytes, err := json.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+
+	return jsonAsBytes, nil
+}
+
+func (t *SimpleChaincode) readAllUsers (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	userIndexAsBytes, err := stub.GetState(userIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get user index")
+	}
+
+	var userIndex []string
+	json.Unmarshal(userIndexAsBytes, &userIndex)
+
+	viewer := t.get_viewer(stub)
+
+	var allUsers []User
+	for _, codCliente := range userIndex {
+		//i clienti vedono solo se stessi
+		if !viewer.canSeeUser(codCliente) {
+			continue
+		}
+
+		user, err := t.get_user(stub, codCliente)
+		if err != nil {
+			return nil, err
+		}
+		allUsers = append(allUsers, user)
+	}
+
+	jsonAsBytes, err := json.Marshal(allUsers)
+	if err != nil {
+		return nil, err
+	}
+
+	return jsonAsBytes, nil
+}
+
+func (t *SimpleChaincode) watches_per_user (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting customer code")
+	}
+
+	user, err := t.get_visible_user(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	viewer := t.get_viewer(stub)
+
+	var watches []WatchView
+	for _, serial := range user.Watches {
+		watch, err := t.get_watch(stub, serial)
+		if err != nil {
+			return nil, err
+		}
+		view, err := t.project_watch(stub, viewer, watch)
+		if err != nil {
+			return nil, err
+		}
+
+		watches = append(watches, view)
+	}
+
+	jsonAsBytes, err := json.Marshal(watches)
+	if err != nil {
+		return nil, err
+	}
+
+	return jsonAsBytes, nil
+}
+
+//==============================================================================================================================
+//	 get_user - Reads a user from the registry, failing with code 00011 if it has never been registered.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) get_user(stub shim.ChaincodeStubInterface, codCliente string) (User, error) {
+
+	var user User
+
+	userAsBytes, err := stub.GetState(ledgerKey(entityUser, codCliente))
+	if err != nil {
+		return user, errors.New("Failed to get user " + codCliente)
+	}
+
+	if userAsBytes == nil {
+		return user, errorResponse("00011", "user " + codCliente + " not registered")
+	}
+
+	user = unmarshUserJson(userAsBytes)
+
+	return user, nil
+}
+
+func (t *SimpleChaincode) put_user(stub shim.ChaincodeStubInterface, user User) error {
+
+	jsonAsBytes, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	return stub.PutState(ledgerKey(entityUser, user.CodCliente), jsonAsBytes)
+}
+
+func (t *SimpleChaincode) add_user_to_index(stub shim.ChaincodeStubInterface, codCliente string) error {
+
+	userIndexAsBytes, err := stub.GetState(userIndexStr)
+	if err != nil {
+		return errors.New("Failed to get user index")
+	}
+
+	var userIndex []string
+	json.Unmarshal(userIndexAsBytes, &userIndex)
+
+	if stringInSlice(codCliente, userIndex) {
+		return nil
+	}
+
+	userIndex = append(userIndex, codCliente)
+	jsonAsBytes, _ := json.Marshal(userIndex)
+
+	return stub.PutState(userIndexStr, jsonAsBytes)
+}
+
+//==============================================================================================================================
+//	 add_watch_to_user - Adds the serial to the watches owned by the customer. A customer authenticating its first
+//						 watch without having been created before is registered on the fly.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) add_watch_to_user(stub shim.ChaincodeStubInterface, codCliente string, serial string) error {
+
+	userAsBytes, err := stub.GetState(ledgerKey(entityUser, codCliente))
+	if err != nil {
+		return errors.New("Failed to get user " + codCliente)
+	}
+
+	var user User
+	if userAsBytes == nil {
+		if !validKeyId(codCliente) {
+			return errors.New("Customer code can not be empty or contain NUL characters")
+		}
+
+		user.CodCliente = codCliente
+		err = t.add_user_to_index(stub, codCliente)
+		if err != nil {
+			return err
+		}
+	} else {
+		user = unmarshUserJson(userAsBytes)
+	}
+
+	if !stringInSlice(serial, user.Watches) {
+		user.Watches = append(user.Watches, serial)
+	}
+
+	return t.put_user(stub, user)
+}
+
+//==============================================================================================================================
+//	 remove_watch_from_user - Removes the serial from the watches owned by the customer.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) remove_watch_from_user(stub shim.ChaincodeStubInterface, codCliente string, serial string) error {
+
+	user, err := t.get_user(stub, codCliente)
+	if err != nil {
+		return err
+	}
+
+	watches := []string{}
+	for _, x := range user.Watches {
+		if x != serial {
+			watches = append(watches, x)
+		}
+	}
+	user.Watches = watches
+
+	return t.put_user(stub, user)
+}
+
+//==============================================================================================================================
+//	 get_visible_user - As get_user, but fails with code 00006 when the caller is not allowed to see which watches the
+//						customer owns: only the customer itself, the supply chain and the auditors can.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) get_visible_user(stub shim.ChaincodeStubInterface, codCliente string) (User, error) {
+
+	if !t.get_viewer(stub).canSeeUser(codCliente) {
+		return User{}, errorResponse("00006", "caller not authorized to read user " + codCliente)
+	}
+
+	return t.get_user(stub, codCliente)
+}
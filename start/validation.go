@@ -0,0 +1,242 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"encoding/json"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// formato ISO delle date dei programmi fedeltà
+var dateLayout = "2006-01-02"
+
+// WatchInput is the payload accepted by create_watch. Status, authentication and secret are set by the chaincode
+// only, so a client can not pass them.
+type WatchInput struct {
+	Serial string 				`json:"serial"`
+	Price json.RawMessage 		`json:"price"`
+	Model string 				`json:"model"`
+	Actor string 				`json:"actor"`
+	Attachments []Attachment 	`json:"attachments"`
+}
+
+// FieldError reports a field of a payload that did not pass validation
+type FieldError struct {
+	Field string 	`json:"field"`
+	Error string 	`json:"error"`
+}
+
+type validationMessage struct {
+	Description string 		`json:"description"`
+	Fields []FieldError 	`json:"fields"`
+}
+
+//==============================================================================================================================
+//	 unmarshWatchInput - Strictly decodes the create_watch payload: unknown fields are rejected and required fields
+//						 are enforced. Failures are returned as a Response with code 00014 listing the fields in error.
+//==============================================================================================================================
+
+func unmarshWatchInput(jsonAsByte []byte) (Watch, error) {
+
+	var input WatchInput
+	var watch Watch
+
+	err := decodeStrict(jsonAsByte, &input)
+	if err != nil {
+		return watch, validationError([]FieldError{ decodeFieldError(err) })
+	}
+
+	var fields []FieldError
+	fields = requireField(fields, "serial", input.Serial)
+	fields = requireField(fields, "model", input.Model)
+	fields = requireField(fields, "actor", input.Actor)
+
+	//il modello è parte della chiave dell'indice per modello
+	if strings.Contains(input.Model, keySeparator) {
+		fields = append(fields, FieldError{ Field: "model", Error: "must not contain NUL characters" })
+	}
+
+	price, priceErr := parsePrice(input.Price)
+	if priceErr != nil {
+		fields = append(fields, FieldError{ Field: "price", Error: priceErr.Error() })
+	}
+
+	for i, attachment := range input.Attachments {
+		fields = requireField(fields, "attachments[" + strconv.Itoa(i) + "].id", attachment.Id)
+		fields = requireField(fields, "attachments[" + strconv.Itoa(i) + "].url", attachment.URL)
+	}
+
+	if len(fields) > 0 {
+		return watch, validationError(fields)
+	}
+
+	watch.Serial = input.Serial
+	watch.Price = price
+	watch.Model = input.Model
+	watch.Actor = input.Actor
+	watch.Attachments = input.Attachments
+
+	return watch, nil
+}
+
+//==============================================================================================================================
+//	 unmarshLoyaltyJson - Strictly decodes the addLoyalty payload: type and ISO start/end dates are required and the
+//						  end date can not precede the start date.
+//==============================================================================================================================
+
+func unmarshLoyaltyJson(jsonAsByte []byte) (Loyalty, error) {
+
+	var loyalty Loyalty
+
+	err := decodeStrict(jsonAsByte, &loyalty)
+	if err != nil {
+		return loyalty, validationError([]FieldError{ decodeFieldError(err) })
+	}
+
+	var fields []FieldError
+	fields = requireField(fields, "type", loyalty.Type)
+
+	if strings.Contains(loyalty.Id, keySeparator) {
+		fields = append(fields, FieldError{ Field: "id", Error: "must not contain NUL characters" })
+	}
+
+	//le loyalty del catalogo si aggiungono con enroll_watch, vedi programs.go
+	if len(loyalty.ProgramId) > 0 {
+		fields = append(fields, FieldError{ Field: "programId", Error: "must be omitted, use enroll_watch for catalog programs" })
+	}
+
+	if loyalty.Legacy {
+		fields = append(fields, FieldError{ Field: "legacy", Error: "must be omitted, it marks the loyalties added before the lifecycle" })
+	}
+
+	//lo stato è gestito dal ciclo di vita della loyalty, vedi loyalties.go
+	if loyalty.Status != loyaltyPending {
+		fields = append(fields, FieldError{ Field: "status", Error: "must be omitted, loyalties are added pending" })
+	}
+
+	startDate, startErr := time.Parse(dateLayout, loyalty.StartDate)
+	if startErr != nil {
+		fields = append(fields, FieldError{ Field: "startDate", Error: "must be an ISO date (YYYY-MM-DD)" })
+	}
+
+	endDate, endErr := time.Parse(dateLayout, loyalty.EndDate)
+	if endErr != nil {
+		fields = append(fields, FieldError{ Field: "endDate", Error: "must be an ISO date (YYYY-MM-DD)" })
+	}
+
+	if startErr == nil && endErr == nil && endDate.Before(startDate) {
+		fields = append(fields, FieldError{ Field: "endDate", Error: "must not precede startDate" })
+	}
+
+	if len(fields) > 0 {
+		return loyalty, validationError(fields)
+	}
+
+	return loyalty, nil
+}
+
+var decimalPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+
+// parsePrice accepts the price either as a json number or as a numeric string, and returns it in the string form
+// stored in Watch.Price
+func parsePrice(raw json.RawMessage) (string, error) {
+
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", errors.New("required")
+	}
+
+	var price string
+	if raw[0] == '"' {
+		err := json.Unmarshal(raw, &price)
+		if err != nil {
+			return "", errors.New("must be a number")
+		}
+	} else {
+		price = string(raw)
+	}
+
+	//solo la forma decimale: ParseFloat accetterebbe anche NaN, Inf, esponenti ed esadecimali
+	if !decimalPattern.MatchString(price) {
+		return "", errors.New("must be a non negative decimal number")
+	}
+
+	value, err := strconv.ParseFloat(price, 64)
+	if err != nil || math.IsInf(value, 0) {
+		return "", errors.New("must be a non negative decimal number")
+	}
+
+	return price, nil
+}
+
+// decodeStrict decodes a single json object, rejecting unknown fields and trailing data
+func decodeStrict(jsonAsByte []byte, value interface{}) error {
+
+	decoder := json.NewDecoder(bytes.NewReader(jsonAsByte))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(value)
+	if err != nil {
+		return err
+	}
+
+	if decoder.More() {
+		return errors.New("unexpected data after the json object")
+	}
+
+	return nil
+}
+
+// decodeFieldError maps a decoding error to the field it refers to, if any
+func decodeFieldError(err error) FieldError {
+
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+		return FieldError{ Field: typeErr.Field, Error: "must be of type " + typeErr.Type.String() }
+	}
+
+	if strings.HasPrefix(err.Error(), "json: unknown field ") {
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		return FieldError{ Field: field, Error: "unknown field" }
+	}
+
+	return FieldError{ Field: "", Error: err.Error() }
+}
+
+func requireField(fields []FieldError, field string, value string) []FieldError {
+	if len(strings.TrimSpace(value)) == 0 {
+		return append(fields, FieldError{ Field: field, Error: "required" })
+	}
+	return fields
+}
+
+// validationError wraps the fields in error into a Response with code 00014
+func validationError(fields []FieldError) error {
+
+	messageAsBytes, _ := json.Marshal(validationMessage{ Description: "invalid payload", Fields: fields })
+
+	var response Response
+	response.Status = -1
+	response.Code = "00014"
+	response.Message = string(messageAsBytes)
+
+	return responseError(response)
+}
@@ -0,0 +1,67 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strconv"
+)
+
+//==============================================================================================================================
+//	 Watch versions - every write of a watch through put_watch increments its version, starting from 1 at create_watch.
+//					  The invokes changing a watch accept the version the client has read as an optional last argument:
+//					  when it is passed and the stored watch has moved on, the invoke fails with code 00023 and nothing
+//					  is written, so the client can read the watch again and retry. Without it the invoke behaves as before.
+//
+//		add_attachment		serial, attachment id, attachment URL [, expected version]
+//		addLoyalty			serial, loyalty [, expected version]
+//		register_watch		serial, secret [, expected version]
+//		authenticate_watch	serial, customer code, secret [, expected version]
+//		move_to_next_actor	serial, next actor [, expected version]
+//		offer_transfer		serial, secret, new owner, transfer token [, expected version]
+//		accept_transfer		serial, new owner, transfer token, new secret [, expected version]
+//		cancel_transfer		serial, secret [, expected version]
+//		activate_loyalty	serial, loyalty id [, expected version]
+//		cancel_loyalty		serial, loyalty id [, expected version]
+//		redeem_loyalty		serial, loyalty id [, expected version]
+//		enroll_watch		serial, program id [, expected version]
+//==============================================================================================================================
+
+// expectedVersion splits the expected version passed after the count arguments of the invoke. The arguments are
+// returned untouched, with a nil version, when there is no extra argument.
+func expectedVersion(args []string, count int) ([]string, *int, error) {
+
+	if len(args) != count + 1 {
+		return args, nil, nil
+	}
+
+	version, err := strconv.Atoi(args[count])
+	if err != nil || version < 0 {
+		return nil, nil, validationError([]FieldError{ { Field: "expectedVersion", Error: "must be a non negative integer" } })
+	}
+
+	return args[:count], &version, nil
+}
+
+// checkVersion fails with code 00023 when the expected version is passed and differs from the stored one
+func checkVersion(serial string, watch Watch, expected *int) error {
+
+	if expected == nil || *expected == watch.Version {
+		return nil
+	}
+
+	return errorResponse("00023", "version conflict on watch " + serial + ": expected version " + strconv.Itoa(*expected) + ", stored version " + strconv.Itoa(watch.Version))
+}
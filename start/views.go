@@ -0,0 +1,163 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// livelli di visibilità di un orologio nelle query
+const (
+	viewPublic		= 0
+	viewOwner		= 1
+	viewParticipant	= 2
+	viewAuditor		= 3
+)
+
+// WatchView is the projection of a Watch returned by the queries. The fields a caller is not allowed to see are
+// left empty and omitted from the json; the secret hash is never part of any projection.
+type WatchView struct {
+	Serial string 				`json:"serial"`
+	Model string 				`json:"model"`
+	Price string 				`json:"price"`
+	Authenticated bool 			`json:"authenticated"`
+	Actor string 				`json:"actor,omitempty"`
+	Status *int 				`json:"status,omitempty"`
+	Attachments []Attachment 	`json:"attachments,omitempty"`
+	Loyalties []Loyalty 		`json:"loyalties,omitempty"`
+	Transfer *Transfer 			`json:"transfer,omitempty"`
+	Version int 				`json:"version"`
+}
+
+// Viewer is the caller of a query, as resolved from its certificate
+type Viewer struct {
+	Name string
+	Role Role
+}
+
+//==============================================================================================================================
+//	 get_viewer - Resolves the caller of a query. Callers whose identity can not be verified only get the public view.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) get_viewer(stub shim.ChaincodeStubInterface) Viewer {
+
+	user, affiliation, err := t.get_caller_affiliation(stub)
+	if err != nil {
+		fmt.Println("caller not resolved, using public view: ", err)
+		return Viewer{ Role: noRole }
+	}
+
+	return Viewer{ Name: user, Role: affiliation }
+}
+
+// viewLevel picks the projection of the watch matching the role of the viewer: auditors see everything, the supply
+// chain sees the internal status, the current holder of the watch sees its own data, anybody else the public view
+func (v Viewer) viewLevel(watch Watch) int {
+	if v.Role == auditor {
+		return viewAuditor
+	}
+
+	if v.Role.isSupplyChain() {
+		return viewParticipant
+	}
+
+	if len(v.Name) > 0 && v.Name == watch.Actor {
+		return viewOwner
+	}
+
+	return viewPublic
+}
+
+// canSeeUser tells whether the viewer can see the customer and the watches it owns, hidden from the public as the
+// actor of the watches is
+func (v Viewer) canSeeUser(codCliente string) bool {
+	return v.Role == auditor || v.Role.isSupplyChain() || (len(v.Name) > 0 && v.Name == codCliente)
+}
+
+// canSeeIndex tells whether the viewer can list the watches by the value of a secondary index: the actor is hidden
+// from the public as in the projection, the status and the loyalty programs are only listed for the supply chain and
+// the auditors
+func (v Viewer) canSeeIndex(entityType string, value string) bool {
+	switch entityType {
+	case entityWatchByActor:
+		return v.canSeeUser(value)
+	case entityWatchByStatus, entityWatchByProgram:
+		return v.Role == auditor || v.Role.isSupplyChain()
+	}
+	return true
+}
+
+func (v Viewer) project(watch Watch) WatchView {
+
+	var view WatchView
+	view.Serial = watch.Serial
+	view.Model = watch.Model
+	view.Price = watch.Price
+	view.Authenticated = watch.Authenticated
+	view.Version = watch.Version
+
+	level := v.viewLevel(watch)
+	if level == viewPublic {
+		return view
+	}
+
+	view.Actor = watch.Actor
+	view.Attachments = watch.Attachments
+	view.Loyalties = watch.Loyalties
+
+	if level == viewOwner {
+		view.Transfer = publicTransfer(watch.Transfer)
+		return view
+	}
+
+	status := watch.Status
+	view.Status = &status
+
+	if level == viewAuditor {
+		view.Transfer = publicTransfer(watch.Transfer)
+	}
+
+	return view
+}
+
+// publicTransfer is the pending transfer without the hash of its token
+func publicTransfer(transfer *Transfer) *Transfer {
+	if transfer == nil {
+		return nil
+	}
+	return &Transfer{ From: transfer.From, To: transfer.To }
+}
+
+// project_watch projects the watch for the viewer, with the loyalties of the catalog resolved to the type and the
+// description of their program, so that filters and readers see them as any other loyalty
+func (t *SimpleChaincode) project_watch(stub shim.ChaincodeStubInterface, viewer Viewer, watch Watch) (WatchView, error) {
+
+	view := viewer.project(watch)
+
+	if len(view.Loyalties) > 0 {
+		//la copia evita di modificare le loyalty dell'orologio caricato
+		view.Loyalties = append([]Loyalty{}, view.Loyalties...)
+
+		err := t.resolve_programs(stub, view.Loyalties)
+		if err != nil {
+			return view, err
+		}
+	}
+
+	return view, nil
+}
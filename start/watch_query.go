@@ -0,0 +1,388 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//==============================================================================================================================
+//	 query_watches - Evaluates a json filter over the watches and returns the matching ones. The filter is applied to
+//					 the projection of each watch visible to the caller, so it can not be used to probe hidden fields.
+//
+//	 {
+//		"where": {
+//			"serial": "...", "model": "...", "actor": "...",			equality
+//			"status": { "gte": 1, "lte": 2 },							range, also "eq", "gt", "lt"
+//			"price": { "gt": 100 },
+//			"authenticated": true,
+//			"hasLoyalty": true,
+//			"loyaltyType": "...",										at least one loyalty matching type and dates
+//			"loyaltyStartDate": { "from": "2017-01-01", "to": "2017-12-31" },
+//			"loyaltyEndDate": { "from": "2018-01-01" }
+//		},
+//		"fields": [ "serial", "status" ],								projection, all the visible fields if omitted
+//		"sort": { "field": "price", "desc": true },						serial order if omitted
+//		"limit": 50
+//	 }
+//==============================================================================================================================
+
+type WatchQuery struct {
+	Where WatchFilter 	`json:"where"`
+	Fields []string 	`json:"fields"`
+	Sort *QuerySort 	`json:"sort"`
+	Limit int 			`json:"limit"`
+}
+
+type WatchFilter struct {
+	Serial *string 					`json:"serial"`
+	Model *string 					`json:"model"`
+	Actor *string 					`json:"actor"`
+	Status *NumberRange 			`json:"status"`
+	Price *NumberRange 				`json:"price"`
+	Authenticated *bool 			`json:"authenticated"`
+	HasLoyalty *bool 				`json:"hasLoyalty"`
+	LoyaltyType *string 			`json:"loyaltyType"`
+	LoyaltyStartDate *DateRange 	`json:"loyaltyStartDate"`
+	LoyaltyEndDate *DateRange 		`json:"loyaltyEndDate"`
+}
+
+type NumberRange struct {
+	Eq *float64 	`json:"eq"`
+	Gt *float64 	`json:"gt"`
+	Gte *float64 	`json:"gte"`
+	Lt *float64 	`json:"lt"`
+	Lte *float64 	`json:"lte"`
+}
+
+type DateRange struct {
+	From string 	`json:"from"`
+	To string 		`json:"to"`
+}
+
+type QuerySort struct {
+	Field string 	`json:"field"`
+	Desc bool 		`json:"desc"`
+}
+
+// QueryResult holds the matching watches, Total counts them before the limit is applied. Missing lists the indexed
+// serials without a stored watch, which are skipped.
+type QueryResult struct {
+	Items []map[string]interface{} 	`json:"items"`
+	Total int 						`json:"total"`
+	Missing []string 				`json:"missing,omitempty"`
+}
+
+var queryFields = []string{ "serial", "model", "price", "authenticated", "actor", "status", "attachments", "loyalties", "transfer" }
+var sortFields = []string{ "serial", "model", "price", "actor", "status" }
+
+func (t *SimpleChaincode) queryWatches (stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting the json query")
+	}
+
+	query, err := unmarshWatchQuery([]byte(args[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	//se il filtro indica modello o attore partiamo dall'indice secondario invece che da tutti gli orologi
+	var serials []string
+	if query.Where.Model != nil {
+		serials, err = t.scan_index(stub, secondaryIndexRange(entityWatchByModel, *query.Where.Model))
+	} else if query.Where.Actor != nil {
+		serials, err = t.scan_index(stub, secondaryIndexRange(entityWatchByActor, *query.Where.Actor))
+	} else {
+		serials, err = t.list_watch_serials(stub)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	viewer := t.get_viewer(stub)
+
+	var result QueryResult
+
+	var matches []WatchView
+	for _, serial := range serials {
+		watch, found, err := t.find_watch(stub, serial)
+		if err != nil {
+			return nil, err
+		}
+
+		//le voci d'indice senza orologio vengono segnalate e saltate
+		if !found {
+			result.Missing = append(result.Missing, serial)
+			continue
+		}
+
+		view, err := t.project_watch(stub, viewer, watch)
+		if err != nil {
+			return nil, err
+		}
+		if query.Where.match(view) {
+			matches = append(matches, view)
+		}
+	}
+
+	if query.Sort != nil {
+		sortViews(matches, *query.Sort)
+	}
+
+	result.Items = []map[string]interface{}{}
+	result.Total = len(matches)
+
+	for i, view := range matches {
+		if i == query.Limit {
+			break
+		}
+
+		item, err := selectFields(view, query.Fields)
+		if err != nil {
+			return nil, err
+		}
+		result.Items = append(result.Items, item)
+	}
+
+	jsonAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+
+	return jsonAsBytes, nil
+}
+
+// unmarshWatchQuery strictly decodes the query and validates fields, sort, limit and dates
+func unmarshWatchQuery(jsonAsByte []byte) (WatchQuery, error) {
+
+	var query WatchQuery
+
+	err := decodeStrict(jsonAsByte, &query)
+	if err != nil {
+		return query, validationError([]FieldError{ decodeFieldError(err) })
+	}
+
+	var fields []FieldError
+
+	for _, field := range query.Fields {
+		if !stringInSlice(field, queryFields) {
+			fields = append(fields, FieldError{ Field: "fields", Error: "unknown field " + field })
+		}
+	}
+
+	if query.Sort != nil && !stringInSlice(query.Sort.Field, sortFields) {
+		fields = append(fields, FieldError{ Field: "sort.field", Error: "must be one of " + strings.Join(sortFields, ", ") })
+	}
+
+	if query.Limit < 0 || query.Limit > maxPageSize {
+		fields = append(fields, FieldError{ Field: "limit", Error: "must be between 1 and " + strconv.Itoa(maxPageSize) })
+	} else if query.Limit == 0 {
+		query.Limit = defaultPageSize
+	}
+
+	fields = validateDateRange(fields, "where.loyaltyStartDate", query.Where.LoyaltyStartDate)
+	fields = validateDateRange(fields, "where.loyaltyEndDate", query.Where.LoyaltyEndDate)
+
+	if len(fields) > 0 {
+		return query, validationError(fields)
+	}
+
+	return query, nil
+}
+
+func validateDateRange(fields []FieldError, field string, dates *DateRange) []FieldError {
+
+	if dates == nil {
+		return fields
+	}
+
+	for _, date := range []string{ dates.From, dates.To } {
+		if len(date) == 0 {
+			continue
+		}
+		_, err := time.Parse(dateLayout, date)
+		if err != nil {
+			fields = append(fields, FieldError{ Field: field, Error: "must be an ISO date (YYYY-MM-DD)" })
+		}
+	}
+
+	return fields
+}
+
+// match tells whether the projected watch satisfies every condition of the filter
+func (f WatchFilter) match(view WatchView) bool {
+
+	if f.Serial != nil && *f.Serial != view.Serial {
+		return false
+	}
+
+	if f.Model != nil && *f.Model != view.Model {
+		return false
+	}
+
+	if f.Actor != nil && *f.Actor != view.Actor {
+		return false
+	}
+
+	if f.Authenticated != nil && *f.Authenticated != view.Authenticated {
+		return false
+	}
+
+	if f.Status != nil && (view.Status == nil || !f.Status.match(float64(*view.Status))) {
+		return false
+	}
+
+	if f.Price != nil {
+		price, err := strconv.ParseFloat(view.Price, 64)
+		if err != nil || !f.Price.match(price) {
+			return false
+		}
+	}
+
+	if f.HasLoyalty != nil && *f.HasLoyalty != (len(view.Loyalties) > 0) {
+		return false
+	}
+
+	if f.LoyaltyType != nil || f.LoyaltyStartDate != nil || f.LoyaltyEndDate != nil {
+		found := false
+		for _, loyalty := range view.Loyalties {
+			if f.matchLoyalty(loyalty) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f WatchFilter) matchLoyalty(loyalty Loyalty) bool {
+
+	if f.LoyaltyType != nil && *f.LoyaltyType != loyalty.Type {
+		return false
+	}
+
+	return f.LoyaltyStartDate.match(loyalty.StartDate) && f.LoyaltyEndDate.match(loyalty.EndDate)
+}
+
+func (r NumberRange) match(value float64) bool {
+	return (r.Eq == nil || value == *r.Eq) &&
+		(r.Gt == nil || value > *r.Gt) &&
+		(r.Gte == nil || value >= *r.Gte) &&
+		(r.Lt == nil || value < *r.Lt) &&
+		(r.Lte == nil || value <= *r.Lte)
+}
+
+// match tells whether the date falls in the range, bounds included. A nil range matches any date.
+func (r *DateRange) match(value string) bool {
+
+	if r == nil {
+		return true
+	}
+
+	date, err := time.Parse(dateLayout, value)
+	if err != nil {
+		return false
+	}
+
+	if len(r.From) > 0 {
+		from, _ := time.Parse(dateLayout, r.From)
+		if date.Before(from) {
+			return false
+		}
+	}
+
+	if len(r.To) > 0 {
+		to, _ := time.Parse(dateLayout, r.To)
+		if date.After(to) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sortViews(views []WatchView, option QuerySort) {
+
+	less := func(a WatchView, b WatchView) bool {
+		switch option.Field {
+		case "model":
+			return a.Model < b.Model
+		case "actor":
+			return a.Actor < b.Actor
+		case "status":
+			return statusValue(a) < statusValue(b)
+		case "price":
+			priceA, _ := strconv.ParseFloat(a.Price, 64)
+			priceB, _ := strconv.ParseFloat(b.Price, 64)
+			return priceA < priceB
+		}
+		return a.Serial < b.Serial
+	}
+
+	sort.SliceStable(views, func(i, j int) bool {
+		if option.Desc {
+			return less(views[j], views[i])
+		}
+		return less(views[i], views[j])
+	})
+}
+
+// statusValue sorts the watches whose status is not visible after all the others
+func statusValue(view WatchView) int {
+	if view.Status == nil {
+		return int(^uint(0) >> 1)
+	}
+	return *view.Status
+}
+
+// selectFields keeps only the requested fields of the projected watch, all of them if none is requested
+func selectFields(view WatchView, fields []string) (map[string]interface{}, error) {
+
+	jsonAsBytes, err := json.Marshal(view)
+	if err != nil {
+		return nil, err
+	}
+
+	var item map[string]interface{}
+	err = json.Unmarshal(jsonAsBytes, &item)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fields) == 0 {
+		return item, nil
+	}
+
+	for key := range item {
+		if !stringInSlice(key, fields) {
+			delete(item, key)
+		}
+	}
+
+	return item, nil
+}